@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/asticode/go-astisub"
+)
+
+// assDrawingPattern matches ASS override tags switching on drawing mode,
+// whose text is vector commands rather than dialogue
+var assDrawingPattern = regexp.MustCompile(`\\p[1-9]`)
+
+// assKaraokePattern matches ASS karaoke tags, which time individual
+// syllables and cannot survive a translation
+var assKaraokePattern = regexp.MustCompile(`\\[kK][fo]?\d`)
+
+// isDialogueItem reports whether a subtitle item holds text to translate.
+// ASS drawings and karaoke lines are left as they are.
+func isDialogueItem(item *astisub.Item) bool {
+	for _, line := range item.Lines {
+		for _, lineItem := range line.Items {
+			markup := lineItem.Text
+			if lineItem.InlineStyle != nil {
+				markup += lineItem.InlineStyle.SSAEffect
+			}
+			if assDrawingPattern.MatchString(markup) || assKaraokePattern.MatchString(markup) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dialogueItems returns the subtitle items that hold text to translate
+func dialogueItems(items []*astisub.Item) []*astisub.Item {
+	var dialogue []*astisub.Item
+	for _, item := range items {
+		if isDialogueItem(item) {
+			dialogue = append(dialogue, item)
+		}
+	}
+	return dialogue
+}
+
+// ensureUniqueIndices numbers the subtitle items from 1 unless every item
+// already has a distinct index. ASS events have no index of their own, but
+// translations are matched to items by index.
+func ensureUniqueIndices(items []*astisub.Item) {
+	seen := make(map[int]bool, len(items))
+	for _, item := range items {
+		if seen[item.Index] {
+			for i, item := range items {
+				item.Index = i + 1
+			}
+			return
+		}
+		seen[item.Index] = true
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// BatchRequest describes a single batch of subtitles to be translated
+type BatchRequest struct {
+	Subtitles      []Subtitle // Subtitles to translate
+	TargetLanguage string     // Target language for translation
+
+	// Read-only context that must not be translated or returned
+	ContextBefore        []Subtitle // Subtitles preceding the batch
+	ContextAfter         []Subtitle // Subtitles following the batch
+	PreviousTranslations []Subtitle // Translations of ContextBefore, if already known
+
+	Glossary []GlossaryEntry // Terms that must be translated as given
+}
+
+// batchContext is the JSON form of the context sent with a batch
+type batchContext struct {
+	Before             []Subtitle `json:"before,omitempty"`
+	BeforeTranslations []Subtitle `json:"before_translated,omitempty"`
+	After              []Subtitle `json:"after,omitempty"`
+}
+
+// contextInstructions explains the context message to the model
+const contextInstructions = `The first user message contains neighbouring subtitles ` +
+	`(and possibly their existing translations) for context only. Use it to keep ` +
+	`pronouns, gender agreement, names and running jokes consistent, but do not ` +
+	`translate it and do not include it in the response. Translate only the ` +
+	`subtitles in the last user message.`
+
+// TranslationBackend is implemented by translation providers
+type TranslationBackend interface {
+	// Name returns the name the backend is registered under
+	Name() string
+	// TranslateBatch translates a batch of subtitles into the target language
+	TranslateBatch(ctx context.Context, request BatchRequest) ([]Subtitle, error)
+}
+
+// ErrTruncatedResponse is returned by backends when the model stopped before
+// completing its reply, usually because the output token limit was reached
+var ErrTruncatedResponse = errors.New("translation response was truncated")
+
+// ErrEmptyResponse is returned by backends when the model replied with no content
+var ErrEmptyResponse = errors.New("translation response was empty")
+
+// BackendError describes a failed request to a translation service
+type BackendError struct {
+	StatusCode int           // HTTP status code, 0 if the request got no response
+	RetryAfter time.Duration // Delay requested by the server before retrying
+	Err        error
+}
+
+func (e *BackendError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("status %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter parses the Retry-After header, given either as a number of
+// seconds or as an HTTP date, as well as the retry-after-ms header used by OpenAI
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// BackendFactory creates a translation backend for the given configuration
+type BackendFactory func(config TranslationConfig) (TranslationBackend, error)
+
+// DefaultBackendName is the backend used when the configuration does not name one
+const DefaultBackendName = "openai"
+
+var (
+	backendFactories      = make(map[string]BackendFactory)
+	backendFactoriesMutex sync.RWMutex
+)
+
+func init() {
+	RegisterTranslationBackend(DefaultBackendName, NewOpenAIBackend)
+}
+
+// RegisterTranslationBackend makes a translation backend available under the given name
+func RegisterTranslationBackend(name string, factory BackendFactory) {
+	backendFactoriesMutex.Lock()
+	defer backendFactoriesMutex.Unlock()
+	backendFactories[name] = factory
+}
+
+// TranslationBackendNames returns the names of all registered backends
+func TranslationBackendNames() []string {
+	backendFactoriesMutex.RLock()
+	defer backendFactoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(backendFactories))
+	for name := range backendFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTranslationBackend creates the backend named in the configuration
+func NewTranslationBackend(config TranslationConfig) (TranslationBackend, error) {
+	name := config.Backend
+	if name == "" {
+		name = DefaultBackendName
+	}
+
+	backendFactoriesMutex.RLock()
+	factory, exists := backendFactories[name]
+	backendFactoriesMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown translation backend '%s'", name)
+	}
+
+	return factory(config)
+}
+
+// OpenAIBackend translates subtitles using the OpenAI chat completions API,
+// or any server implementing it
+type OpenAIBackend struct {
+	client         openai.Client
+	model          string
+	responseFormat string
+}
+
+// responseFormatInstructions describes the expected reply to servers that
+// cannot enforce a JSON schema themselves
+const responseFormatInstructions = `Respond only with a JSON object of the form ` +
+	`{"subtitles":[{"index":1,"lines":[{"items":[{"text":"..."}]}]}]}, ` +
+	`keeping the index, line and item structure of the input.`
+
+// NewOpenAIBackend creates an OpenAI backend for the given configuration,
+// connecting to the server described by the openai section of the config
+func NewOpenAIBackend(config TranslationConfig) (TranslationBackend, error) {
+	openaiConfig := GetOpenAIConfig()
+
+	apiKey, err := openaiConfig.ResolveAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" {
+		if openaiConfig.BaseURL == "" {
+			return nil, fmt.Errorf("no OpenAI API key configured")
+		}
+		// Local servers usually ignore the key, but the header must be set
+		apiKey = "no-key"
+	}
+
+	// Retries are handled by the Translator so that they follow the
+	// configured backoff policy
+	options := []option.RequestOption{
+		option.WithAPIKey(apiKey),
+		option.WithMaxRetries(0),
+	}
+	if openaiConfig.BaseURL != "" {
+		options = append(options, option.WithBaseURL(openaiConfig.BaseURL))
+	}
+	if openaiConfig.Timeout > 0 {
+		options = append(options, option.WithRequestTimeout(openaiConfig.Timeout))
+	}
+
+	responseFormat := openaiConfig.ResponseFormat
+	switch responseFormat {
+	case "":
+		responseFormat = ResponseFormatJSONSchema
+	case ResponseFormatJSONSchema, ResponseFormatJSONObject, ResponseFormatText:
+	default:
+		return nil, fmt.Errorf("unsupported response format '%s'", responseFormat)
+	}
+
+	model := config.Model
+	if model == "" {
+		model = openaiConfig.Model
+	}
+
+	return &OpenAIBackend{
+		client:         openai.NewClient(options...),
+		model:          model,
+		responseFormat: responseFormat,
+	}, nil
+}
+
+// Name returns the name of the backend
+func (b *OpenAIBackend) Name() string {
+	return DefaultBackendName
+}
+
+// TranslateBatch translates a batch of subtitles, using structured outputs
+// when the server supports them
+func (b *OpenAIBackend) TranslateBatch(ctx context.Context, request BatchRequest) ([]Subtitle, error) {
+	// Marshal the subtitles to JSON
+	jsonData, err := json.Marshal(request.Subtitles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal subtitles: %w", err)
+	}
+
+	// Prepare the system message based on target language
+	systemMessage := fmt.Sprintf("Translate subtitles to %s", request.TargetLanguage)
+	messages := []openai.ChatCompletionMessageParamUnion{openai.SystemMessage(systemMessage)}
+
+	// Send neighbouring subtitles in a separate message so they are not translated
+	if len(request.ContextBefore) > 0 || len(request.ContextAfter) > 0 {
+		contextData, err := json.Marshal(batchContext{
+			Before:             request.ContextBefore,
+			BeforeTranslations: request.PreviousTranslations,
+			After:              request.ContextAfter,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal context: %w", err)
+		}
+		systemMessage += ". " + contextInstructions
+		messages = append(messages, openai.UserMessage(string(contextData)))
+	}
+	if containsPlaceholders(request.Subtitles) {
+		systemMessage += ". " + placeholderInstructions
+	}
+	if len(request.Glossary) > 0 {
+		systemMessage += ". " + glossaryInstructions(request.Glossary)
+	}
+	messages[0] = openai.SystemMessage(systemMessage)
+	messages = append(messages, openai.UserMessage(string(jsonData)))
+
+	params := openai.ChatCompletionNewParams{
+		Messages: messages,
+		Model:    b.model,
+	}
+
+	switch b.responseFormat {
+	case ResponseFormatJSONSchema:
+		// Configure the JSON schema for the response
+		params.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{
+				JSONSchema: openai.ResponseFormatJSONSchemaJSONSchemaParam{
+					Name:        "subtitles",
+					Description: openai.String("Translated subtitles"),
+					Schema:      TranslationResponseSchema,
+					Strict:      openai.Bool(true),
+				},
+			},
+		}
+	case ResponseFormatJSONObject:
+		params.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONObject: &openai.ResponseFormatJSONObjectParam{},
+		}
+		params.Messages[0] = openai.SystemMessage(systemMessage + ". " + responseFormatInstructions)
+	default:
+		params.Messages[0] = openai.SystemMessage(systemMessage + ". " + responseFormatInstructions)
+	}
+
+	// Call the API for translation
+	response, err := b.client.Chat.Completions.New(ctx, params)
+	if err != nil {
+		backendErr := &BackendError{Err: err}
+		var apiErr *openai.Error
+		if errors.As(err, &apiErr) {
+			backendErr.StatusCode = apiErr.StatusCode
+			if apiErr.Response != nil {
+				backendErr.RetryAfter = parseRetryAfter(apiErr.Response.Header)
+			}
+		}
+		return nil, fmt.Errorf("failed to call translation API: %w", backendErr)
+	}
+
+	if len(response.Choices) == 0 {
+		return nil, ErrEmptyResponse
+	}
+
+	choice := response.Choices[0]
+	if choice.FinishReason == "length" {
+		return nil, ErrTruncatedResponse
+	}
+	if choice.Message.Refusal != "" {
+		return nil, fmt.Errorf("model refused to translate: %s", choice.Message.Refusal)
+	}
+	if strings.TrimSpace(choice.Message.Content) == "" {
+		return nil, ErrEmptyResponse
+	}
+
+	// Unmarshal the response
+	var translationResponse TranslationResponse
+	err = json.Unmarshal([]byte(stripCodeFence(choice.Message.Content)), &translationResponse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal translation response: %w", err)
+	}
+
+	return translationResponse.Subtitles, nil
+}
+
+// glossaryInstructions lists the glossary terms the model must follow
+func glossaryInstructions(entries []GlossaryEntry) string {
+	var builder strings.Builder
+	builder.WriteString("Always translate these terms as given, inflecting them only where the grammar requires it:")
+	for _, entry := range entries {
+		fmt.Fprintf(&builder, "\n- %q -> %q", entry.Source, entry.Target)
+		if entry.Note != "" {
+			fmt.Fprintf(&builder, " (%s)", entry.Note)
+		}
+	}
+	return builder.String()
+}
+
+// stripCodeFence removes a markdown code fence that some models wrap
+// around JSON when no response format is enforced
+func stripCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```")
+	if newline := strings.Index(content, "\n"); newline != -1 {
+		content = content[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+}
@@ -0,0 +1,28 @@
+package main
+
+// Checkpoint stores the translations of finished batches, so that an
+// interrupted translation can resume where it stopped
+type Checkpoint interface {
+	// Load returns the translations saved so far
+	Load() ([]Subtitle, error)
+	// Save adds the translations of a finished batch. A translator does not
+	// call it concurrently.
+	Save(translations []Subtitle) error
+}
+
+// jobCheckpoint is the checkpoint of a job's translation into one language
+type jobCheckpoint struct {
+	store    JobStore
+	jobID    string
+	language string
+}
+
+// Load returns the translations saved for the job and language
+func (c *jobCheckpoint) Load() ([]Subtitle, error) {
+	return c.store.LoadCheckpoint(c.jobID, c.language)
+}
+
+// Save adds translations to the checkpoint of the job and language
+func (c *jobCheckpoint) Save(translations []Subtitle) error {
+	return c.store.SaveCheckpoint(c.jobID, c.language, translations)
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -11,11 +14,17 @@ import (
 
 // Config represents the application configuration structure
 type Config struct {
-	WebService   WebServiceConfig           `yaml:"web_service"`
-	MediaPaths   map[string]MediaPathConfig `yaml:"media_paths"`
-	Database     DatabaseConfig             `yaml:"database"`
-	SyncInterval time.Duration              `yaml:"sync_interval"`
-	LogLevel     string                     `yaml:"log_level"`
+	WebService     WebServiceConfig           `yaml:"web_service"`
+	MediaPaths     map[string]MediaPathConfig `yaml:"media_paths"`
+	Database       DatabaseConfig             `yaml:"database"`
+	OpenAI         OpenAIConfig               `yaml:"openai"`
+	Translation    TranslationConfig          `yaml:"translation"`
+	Output         OutputConfig               `yaml:"output"`
+	Jobs           JobsConfig                 `yaml:"jobs"`
+	Webhooks       []WebhookConfig            `yaml:"webhooks"`
+	TrackSelection TrackSelectionConfig       `yaml:"track_selection"`
+	SyncInterval   time.Duration              `yaml:"sync_interval"`
+	LogLevel       string                     `yaml:"log_level"`
 }
 
 // DatabaseConfig contains database specific configuration
@@ -28,15 +37,111 @@ type WebServiceConfig struct {
 	Port int `yaml:"port"`
 }
 
+// JobsConfig contains settings for translation jobs
+type JobsConfig struct {
+	// Restart jobs interrupted by a restart instead of marking them failed
+	ResumeInterrupted bool `yaml:"resume_interrupted"`
+	// Number of jobs processed at the same time
+	Workers int `yaml:"workers"`
+	// Maximum number of jobs waiting for a worker, 0 for no limit
+	QueueSize int `yaml:"queue_size"`
+	// How long a completed job is reused for requests for its languages
+	// instead of translating again, 0 to only deduplicate active jobs
+	DuplicateWindow time.Duration `yaml:"duplicate_window"`
+}
+
+// OpenAIConfig contains settings for the OpenAI translation backend. Any
+// OpenAI-compatible server (llama.cpp, vLLM, Ollama, LM Studio) can be used
+// by pointing BaseURL at its /v1 endpoint.
+type OpenAIConfig struct {
+	BaseURL        string        `yaml:"base_url"`        // API base URL, empty for api.openai.com
+	APIKey         string        `yaml:"api_key"`         // API key given inline
+	APIKeyFile     string        `yaml:"api_key_file"`    // File to read the API key from
+	APIKeyEnv      string        `yaml:"api_key_env"`     // Environment variable holding the API key
+	Model          string        `yaml:"model"`           // Model name as understood by the server
+	ResponseFormat string        `yaml:"response_format"` // json_schema, json_object or text
+	Timeout        time.Duration `yaml:"timeout"`         // Per request timeout, 0 for no timeout
+}
+
+// Supported values for OpenAIConfig.ResponseFormat
+const (
+	ResponseFormatJSONSchema = "json_schema"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatText       = "text"
+)
+
+// ResolveAPIKey returns the API key from the first configured source:
+// the inline key, the key file, then the environment variable
+func (c OpenAIConfig) ResolveAPIKey() (string, error) {
+	if c.APIKey != "" {
+		return c.APIKey, nil
+	}
+
+	if c.APIKeyFile != "" {
+		data, err := os.ReadFile(c.APIKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read API key file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	envName := c.APIKeyEnv
+	if envName == "" {
+		envName = DefaultAPIKeyEnv
+	}
+	return os.Getenv(envName), nil
+}
+
+// OutputConfig controls how translated subtitle files are named and where
+// they are written
+type OutputConfig struct {
+	// Template for the output file name. Supported placeholders are {base},
+	// {sep}, {lang}, {ext} and the optional {.ext}, {.forced}, {.sdh} and
+	// {.hi}, which expand to nothing if the input has no such segment.
+	Template string `yaml:"template"`
+	// Directory to write outputs to, relative to the input file unless
+	// absolute. Empty to write next to the input file.
+	Directory string `yaml:"directory"`
+	// How translations of video files are delivered: sidecar files only,
+	// or also added as tracks to a copy of the video or to the video itself
+	Mode string `yaml:"mode"`
+	// Title of the tracks added to videos, {language} is replaced by the
+	// name of the language
+	TrackTitle string `yaml:"track_title"`
+	// Mark the first track added to a video as default, unset to inherit
+	// the global setting in media path overrides
+	DefaultTrack *bool `yaml:"default_track"`
+}
+
+// defaultTrack reports whether the first track added to a video is default
+func (c OutputConfig) defaultTrack() bool {
+	return c.DefaultTrack != nil && *c.DefaultTrack
+}
+
+// Supported values for OutputConfig.Mode
+const (
+	OutputModeSidecar    = "sidecar"     // Subtitle files next to the input
+	OutputModeMuxCopy    = "mux_copy"    // Also a copy of the video with the translations
+	OutputModeMuxReplace = "mux_replace" // Also the translations added to the video itself
+)
+
+// DefaultTrackTitle is the title of tracks added to videos, e.g. "Polish (AI)"
+const DefaultTrackTitle = "{language} (AI)"
+
 // MediaPathConfig represents a named media path with its properties
 type MediaPathConfig struct {
-	Path        string `yaml:"path"`
-	Description string `yaml:"description"`
+	Path        string       `yaml:"path"`
+	Description string       `yaml:"description"`
+	Output      OutputConfig `yaml:"output"`   // Overrides the global output settings
+	Glossary    string       `yaml:"glossary"` // YAML glossary file used for all files in the path
+	Backend     string       `yaml:"backend"`  // Translation backend used for files in the path
 }
 
 // Default configuration values
 const (
-	DefaultPort = 8080
+	DefaultPort      = 8080
+	DefaultModel     = "gpt-4o-mini"
+	DefaultAPIKeyEnv = "OPENAI_API_KEY"
 )
 
 var (
@@ -58,7 +163,29 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// Create config with default values
-	config := &Config{
+	config := newDefaultConfig()
+
+	// Parse YAML
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+// newDefaultConfig returns a configuration populated with default values
+func newDefaultConfig() *Config {
+	translation := DefaultTranslationConfig()
+	// Left empty so that the model from the backend section applies
+	translation.Model = ""
+
+	return &Config{
 		WebService: WebServiceConfig{
 			Port: DefaultPort,
 		},
@@ -66,15 +193,86 @@ func LoadConfig(configPath string) (*Config, error) {
 		Database: DatabaseConfig{
 			Path: "default.db",
 		},
+		OpenAI: OpenAIConfig{
+			APIKeyEnv:      DefaultAPIKeyEnv,
+			Model:          DefaultModel,
+			ResponseFormat: ResponseFormatJSONSchema,
+		},
+		Translation:    translation,
+		TrackSelection: DefaultTrackSelectionConfig(),
+		Jobs: JobsConfig{
+			ResumeInterrupted: true,
+			Workers:           2,
+			QueueSize:         1000,
+			DuplicateWindow:   10 * time.Minute,
+		},
 	}
+}
 
-	// Parse YAML
-	err = yaml.Unmarshal(data, config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+// applyDefaults fills in values that depend on other configuration sections
+func (c *Config) applyDefaults() {
+	if c.Translation.Model == "" {
+		c.Translation.Model = c.OpenAI.Model
+	}
+	if c.Translation.Backend == "" {
+		c.Translation.Backend = DefaultBackendName
+	}
+}
+
+// validate checks the configuration for values that cannot work
+func (c *Config) validate() error {
+	switch c.OpenAI.ResponseFormat {
+	case ResponseFormatJSONSchema, ResponseFormatJSONObject, ResponseFormatText:
+	default:
+		return fmt.Errorf("openai: unsupported response format '%s'", c.OpenAI.ResponseFormat)
 	}
 
-	return config, nil
+	if err := c.Translation.Validate(); err != nil {
+		return fmt.Errorf("translation: %w", err)
+	}
+
+	if c.Jobs.Workers <= 0 {
+		return fmt.Errorf("jobs: workers must be positive, got %d", c.Jobs.Workers)
+	}
+	if c.Jobs.QueueSize < 0 {
+		return fmt.Errorf("jobs: queue size cannot be negative, got %d", c.Jobs.QueueSize)
+	}
+	if c.Jobs.DuplicateWindow < 0 {
+		return fmt.Errorf("jobs: duplicate window cannot be negative, got %s", c.Jobs.DuplicateWindow)
+	}
+
+	for i, webhook := range c.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return fmt.Errorf("webhook %d: %w", i+1, err)
+		}
+	}
+
+	if err := c.Output.validate(); err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	for name, mediaPath := range c.MediaPaths {
+		if err := mediaPath.Output.validate(); err != nil {
+			return fmt.Errorf("media path '%s' output: %w", name, err)
+		}
+		if mediaPath.Backend != "" && !slices.Contains(TranslationBackendNames(), mediaPath.Backend) {
+			return fmt.Errorf("media path '%s': unknown backend '%s'", name, mediaPath.Backend)
+		}
+	}
+
+	return nil
+}
+
+// validate checks that outputs for different languages get different names
+func (c OutputConfig) validate() error {
+	if c.Template != "" && !strings.Contains(c.Template, "{lang}") {
+		return fmt.Errorf("template '%s' must contain {lang}", c.Template)
+	}
+	switch c.Mode {
+	case "", OutputModeSidecar, OutputModeMuxCopy, OutputModeMuxReplace:
+	default:
+		return fmt.Errorf("unsupported mode '%s'", c.Mode)
+	}
+	return nil
 }
 
 // GetConfig returns the global configuration instance, loading it if necessary
@@ -101,12 +299,8 @@ func GetConfig() *Config {
 		// If no config file was found, use defaults
 		if appConfig == nil {
 			slog.Info("Using default configuration")
-			appConfig = &Config{
-				WebService: WebServiceConfig{
-					Port: DefaultPort,
-				},
-				MediaPaths: make(map[string]MediaPathConfig),
-			}
+			appConfig = newDefaultConfig()
+			appConfig.applyDefaults()
 		}
 	}
 
@@ -127,6 +321,99 @@ func GetMediaPath(name string) (string, error) {
 	return mediaPath.Path, nil
 }
 
+// GetOpenAIConfig returns the OpenAI backend configuration
+func GetOpenAIConfig() OpenAIConfig {
+	return GetConfig().OpenAI
+}
+
+// GetTranslationConfig returns the translation configuration
+func GetTranslationConfig() TranslationConfig {
+	return GetConfig().Translation
+}
+
+// GetTrackSelectionConfig returns the policy choosing subtitles to translate
+func GetTrackSelectionConfig() TrackSelectionConfig {
+	return GetConfig().TrackSelection
+}
+
+// GetJobsConfig returns the job settings
+func GetJobsConfig() JobsConfig {
+	return GetConfig().Jobs
+}
+
+// GetTranslationConfigForFile returns the translation settings for a file,
+// using the backend requested for the job, or else the one of the media path
+// containing the file
+func GetTranslationConfigForFile(filePath string, backend string) TranslationConfig {
+	return GetConfig().translationConfigForFile(filePath, backend)
+}
+
+// translationConfigForFile applies the backend overrides to the translation settings
+func (c *Config) translationConfigForFile(filePath string, backend string) TranslationConfig {
+	config := c.Translation
+	if _, mediaPath, found := c.mediaPathForFile(filePath); found && mediaPath.Backend != "" {
+		config.Backend = mediaPath.Backend
+	}
+	if backend != "" {
+		config.Backend = backend
+	}
+	return config
+}
+
+// GetMediaPathForFile returns the name and configuration of the media path
+// containing the given file, preferring the most specific one
+func GetMediaPathForFile(filePath string) (string, MediaPathConfig, bool) {
+	return GetConfig().mediaPathForFile(filePath)
+}
+
+// mediaPathForFile finds the most specific media path containing the file
+func (c *Config) mediaPathForFile(filePath string) (string, MediaPathConfig, bool) {
+	var bestName string
+	var best MediaPathConfig
+	found := false
+
+	for name, mediaPath := range c.MediaPaths {
+		root := filepath.Clean(mediaPath.Path)
+		if filePath != root && !strings.HasPrefix(filePath, root+string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(root) > len(filepath.Clean(best.Path)) {
+			bestName, best, found = name, mediaPath, true
+		}
+	}
+
+	return bestName, best, found
+}
+
+// GetOutputConfig returns the output settings for a file, applying the
+// overrides of the media path containing it
+func GetOutputConfig(filePath string) OutputConfig {
+	return GetConfig().outputConfigForFile(filePath)
+}
+
+// outputConfigForFile applies the media path overrides to the output settings
+func (c *Config) outputConfigForFile(filePath string) OutputConfig {
+	output := c.Output
+	if _, mediaPath, found := c.mediaPathForFile(filePath); found {
+		if mediaPath.Output.Template != "" {
+			output.Template = mediaPath.Output.Template
+		}
+		if mediaPath.Output.Directory != "" {
+			output.Directory = mediaPath.Output.Directory
+		}
+		if mediaPath.Output.Mode != "" {
+			output.Mode = mediaPath.Output.Mode
+		}
+		if mediaPath.Output.TrackTitle != "" {
+			output.TrackTitle = mediaPath.Output.TrackTitle
+		}
+		if mediaPath.Output.DefaultTrack != nil {
+			output.DefaultTrack = mediaPath.Output.DefaultTrack
+		}
+	}
+	return output
+}
+
 // GetAllMediaPaths returns all configured media paths
 func GetAllMediaPaths() map[string]MediaPathConfig {
 	return GetConfig().MediaPaths
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -76,18 +79,105 @@ func (db *DB) initialize() error {
 		embedded INTEGER NOT NULL,
 		subtitle_type TEXT,
 		title TEXT,
+		stream_index INTEGER,
+		codec_long_name TEXT,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		forced INTEGER NOT NULL DEFAULT 0,
+		hearing_impaired INTEGER NOT NULL DEFAULT 0,
+		comment INTEGER NOT NULL DEFAULT 0,
 		FOREIGN KEY (video_id) REFERENCES videos(id) ON DELETE CASCADE,
 		UNIQUE(video_id, path, track_index) ON CONFLICT REPLACE
 	);
 
+	CREATE TABLE IF NOT EXISTS translation_memory (
+		source_text TEXT NOT NULL,
+		source_language TEXT NOT NULL,
+		target_language TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt_version TEXT NOT NULL,
+		translation TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (source_text, source_language, target_language, model, prompt_version)
+	);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		progress REAL NOT NULL,
+		path TEXT NOT NULL,
+		track_index INTEGER NOT NULL,
+		target_languages TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		backend TEXT,
+		result TEXT NOT NULL,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS job_checkpoints (
+		job_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		cue_index INTEGER NOT NULL,
+		translation TEXT NOT NULL,
+		PRIMARY KEY (job_id, language, cue_index)
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_videos_path ON videos(path);
 	CREATE INDEX IF NOT EXISTS idx_subtitles_video_id ON subtitles(video_id);
+	CREATE INDEX IF NOT EXISTS idx_jobs_created_at ON jobs(created_at);
 	`)
 
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %v", err)
 	}
 
+	// Columns added after the tables were first released
+	migrations := []struct{ table, column, definition string }{
+		{"subtitles", "stream_index", "INTEGER"},
+		{"subtitles", "codec_long_name", "TEXT"},
+		{"subtitles", "is_default", "INTEGER NOT NULL DEFAULT 0"},
+		{"subtitles", "forced", "INTEGER NOT NULL DEFAULT 0"},
+		{"subtitles", "hearing_impaired", "INTEGER NOT NULL DEFAULT 0"},
+		{"subtitles", "comment", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, migration := range migrations {
+		if err := db.addColumn(migration.table, migration.column, migration.definition); err != nil {
+			return fmt.Errorf("failed to migrate database: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// upgrading databases created by older versions
+func (db *DB) addColumn(table, column, definition string) error {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to get columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return fmt.Errorf("failed to scan column of %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating columns of %s: %v", table, err)
+	}
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %v", column, table, err)
+	}
 	return nil
 }
 
@@ -128,9 +218,10 @@ func (db *DB) CacheMediaFiles(mediaFiles []GroupedMediaFile) error {
 	insertSubtitle, err := tx.Prepare(`
 		INSERT OR REPLACE INTO subtitles (
 			video_id, path, track_index, language, format,
-			embedded, subtitle_type, title
+			embedded, subtitle_type, title, stream_index, codec_long_name,
+			is_default, forced, hearing_impaired, comment
 		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare subtitle insert statement: %v", err)
@@ -169,6 +260,10 @@ func (db *DB) CacheMediaFiles(mediaFiles []GroupedMediaFile) error {
 			if sub.Embedded {
 				embedded = 1
 			}
+			var streamIndex sql.NullInt64
+			if sub.StreamIndex != nil {
+				streamIndex = sql.NullInt64{Int64: int64(*sub.StreamIndex), Valid: true}
+			}
 
 			_, err = insertSubtitle.Exec(
 				sqlNullInt64(videoID),
@@ -179,6 +274,12 @@ func (db *DB) CacheMediaFiles(mediaFiles []GroupedMediaFile) error {
 				embedded,
 				sqlNullString(sub.SubtitleType),
 				sqlNullString(sub.Title),
+				streamIndex,
+				sqlNullString(sub.CodecLongName),
+				sub.Default,
+				sub.Forced,
+				sub.HearingImpaired,
+				sub.Comment,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to insert subtitle: %v", err)
@@ -231,7 +332,8 @@ func (db *DB) GetCachedMediaFiles(dirPath string) ([]GroupedMediaFile, error) {
 	// Query to get all subtitles for these videos
 	subtitles, err := db.conn.Query(`
 		SELECT video_id, path, track_index, language, format,
-		       embedded, subtitle_type, title
+		       embedded, subtitle_type, title, stream_index, codec_long_name,
+		       is_default, forced, hearing_impaired, comment
 		FROM subtitles
 		WHERE video_id IN (
 			SELECT id FROM videos WHERE path LIKE ? || '%'
@@ -250,27 +352,41 @@ func (db *DB) GetCachedMediaFiles(dirPath string) ([]GroupedMediaFile, error) {
 		var language, format string
 		var embedded int
 		var subType, title sql.NullString
+		var streamIndex sql.NullInt64
+		var codecLongName sql.NullString
+		var isDefault, forced, hearingImpaired, comment bool
 
 		if err := subtitles.Scan(
 			&videoID, &path, &trackIndex, &language, &format,
-			&embedded, &subType, &title,
+			&embedded, &subType, &title, &streamIndex, &codecLongName,
+			&isDefault, &forced, &hearingImpaired, &comment,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan subtitle row: %v", err)
 		}
 
 		// Create subtitle info
 		subtitleInfo := SubtitleInfo{
-			TrackIndex:   trackIndex,
-			Language:     language,
-			Format:       format,
-			Embedded:     embedded == 1,
-			SubtitleType: nullStringValue(subType),
-			Title:        nullStringValue(title),
+			TrackIndex:      trackIndex,
+			Language:        language,
+			Format:          format,
+			CodecLongName:   nullStringValue(codecLongName),
+			Embedded:        embedded == 1,
+			SubtitleType:    nullStringValue(subType),
+			Title:           nullStringValue(title),
+			Default:         isDefault,
+			Forced:          forced,
+			HearingImpaired: hearingImpaired,
+			Comment:         comment,
+			Text:            isTextSubtitleCodec(format),
 		}
 
 		if path.Valid {
 			subtitleInfo.Path = path.String
 		}
+		if streamIndex.Valid {
+			index := int(streamIndex.Int64)
+			subtitleInfo.StreamIndex = &index
+		}
 
 		// Add to appropriate video or as an orphaned subtitle
 		if videoID.Valid {
@@ -336,7 +452,8 @@ func (db *DB) GetCachedMediaFile(videoPath string) (*GroupedMediaFile, error) {
 	// Get all subtitles for this video
 	rows, err := db.conn.Query(`
 		SELECT path, track_index, language, format,
-		       embedded, subtitle_type, title
+		       embedded, subtitle_type, title, stream_index, codec_long_name,
+		       is_default, forced, hearing_impaired, comment
 		FROM subtitles
 		WHERE video_id = ?
 	`, videoID)
@@ -352,27 +469,41 @@ func (db *DB) GetCachedMediaFile(videoPath string) (*GroupedMediaFile, error) {
 		var language, format string
 		var embedded int
 		var subType, title sql.NullString
+		var streamIndex sql.NullInt64
+		var codecLongName sql.NullString
+		var isDefault, forced, hearingImpaired, comment bool
 
 		if err := rows.Scan(
 			&path, &trackIndex, &language, &format,
-			&embedded, &subType, &title,
+			&embedded, &subType, &title, &streamIndex, &codecLongName,
+			&isDefault, &forced, &hearingImpaired, &comment,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan subtitle row: %v", err)
 		}
 
 		// Create subtitle info
 		subtitleInfo := SubtitleInfo{
-			TrackIndex:   trackIndex,
-			Language:     language,
-			Format:       format,
-			Embedded:     embedded == 1,
-			SubtitleType: nullStringValue(subType),
-			Title:        nullStringValue(title),
+			TrackIndex:      trackIndex,
+			Language:        language,
+			Format:          format,
+			CodecLongName:   nullStringValue(codecLongName),
+			Embedded:        embedded == 1,
+			SubtitleType:    nullStringValue(subType),
+			Title:           nullStringValue(title),
+			Default:         isDefault,
+			Forced:          forced,
+			HearingImpaired: hearingImpaired,
+			Comment:         comment,
+			Text:            isTextSubtitleCodec(format),
 		}
 
 		if path.Valid {
 			subtitleInfo.Path = path.String
 		}
+		if streamIndex.Valid {
+			index := int(streamIndex.Int64)
+			subtitleInfo.StreamIndex = &index
+		}
 
 		result.Subtitles = append(result.Subtitles, subtitleInfo)
 	}
@@ -383,6 +514,252 @@ func (db *DB) GetCachedMediaFile(videoPath string) (*GroupedMediaFile, error) {
 	return result, nil
 }
 
+// SaveJob stores the current state of a job, replacing the previous one.
+// Timestamps are stored in milliseconds to keep jobs created within the same
+// second in order.
+func (db *DB) SaveJob(job Job) error {
+	targetLanguages, err := json.Marshal(job.TargetLanguages)
+	if err != nil {
+		return fmt.Errorf("failed to marshal target languages: %v", err)
+	}
+	result, err := json.Marshal(job.Result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job result: %v", err)
+	}
+
+	_, err = db.conn.Exec(`
+		INSERT OR REPLACE INTO jobs (
+			id, status, progress, path, track_index, target_languages,
+			priority, backend, result, error, created_at, updated_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, string(job.Status), job.Progress, job.Path, job.TrackIndex, string(targetLanguages),
+		job.Priority, sqlNullString(job.Backend), string(result), sqlNullString(job.Result.Error), job.CreatedAt.UnixMilli(), job.UpdatedAt.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to save job: %v", err)
+	}
+	return nil
+}
+
+// LoadJobs returns all stored jobs, oldest first
+func (db *DB) LoadJobs() ([]*Job, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, status, progress, path, track_index, target_languages,
+			priority, backend, result, created_at, updated_at
+		FROM jobs
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query jobs: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		var job Job
+		var status, targetLanguages, result string
+		var backend sql.NullString
+		var createdAt, updatedAt int64
+		err := rows.Scan(&job.ID, &status, &job.Progress, &job.Path, &job.TrackIndex,
+			&targetLanguages, &job.Priority, &backend, &result, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job row: %v", err)
+		}
+
+		job.Status = JobStatus(status)
+		job.Backend = nullStringValue(backend)
+		job.CreatedAt = time.UnixMilli(createdAt)
+		job.UpdatedAt = time.UnixMilli(updatedAt)
+		if err := json.Unmarshal([]byte(targetLanguages), &job.TargetLanguages); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal target languages of job %s: %v", job.ID, err)
+		}
+		if err := json.Unmarshal([]byte(result), &job.Result); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal result of job %s: %v", job.ID, err)
+		}
+		jobs = append(jobs, &job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating job rows: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// LoadCheckpoint returns the translations saved for a job and target language
+func (db *DB) LoadCheckpoint(jobID, language string) ([]Subtitle, error) {
+	rows, err := db.conn.Query(`
+		SELECT cue_index, translation
+		FROM job_checkpoints
+		WHERE job_id = ? AND language = ?
+		ORDER BY cue_index
+	`, jobID, language)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query checkpoint: %v", err)
+	}
+	defer rows.Close()
+
+	var translations []Subtitle
+	for rows.Next() {
+		var sub Subtitle
+		var translation string
+		if err := rows.Scan(&sub.Index, &translation); err != nil {
+			return nil, fmt.Errorf("failed to scan checkpoint row: %v", err)
+		}
+		if err := json.Unmarshal([]byte(translation), &sub.Lines); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal checkpoint of cue %d: %v", sub.Index, err)
+		}
+		translations = append(translations, sub)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating checkpoint rows: %v", err)
+	}
+
+	return translations, nil
+}
+
+// SaveCheckpoint adds translations to the checkpoint of a job and target language
+func (db *DB) SaveCheckpoint(jobID, language string, translations []Subtitle) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	insert, err := tx.Prepare(`
+		INSERT OR REPLACE INTO job_checkpoints (job_id, language, cue_index, translation)
+		VALUES (?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare checkpoint insert statement: %v", err)
+	}
+	defer insert.Close()
+
+	for _, sub := range translations {
+		var translation []byte
+		translation, err = json.Marshal(sub.Lines)
+		if err != nil {
+			return fmt.Errorf("failed to marshal translation: %v", err)
+		}
+		if _, err = insert.Exec(jobID, language, sub.Index, string(translation)); err != nil {
+			return fmt.Errorf("failed to insert checkpoint: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCheckpoints removes all checkpoints of a job
+func (db *DB) DeleteCheckpoints(jobID string) error {
+	_, err := db.conn.Exec("DELETE FROM job_checkpoints WHERE job_id = ?", jobID)
+	return err
+}
+
+// TranslationMemoryKey identifies the translation settings cached translations
+// were made with, so that they are only reused for identical settings
+type TranslationMemoryKey struct {
+	SourceLanguage string
+	TargetLanguage string
+	Model          string
+	PromptVersion  string
+}
+
+// LookupTranslations returns the cached translations for the given normalized
+// source texts, keyed by source text
+func (db *DB) LookupTranslations(key TranslationMemoryKey, sourceTexts []string) (map[string][]Line, error) {
+	result := make(map[string][]Line)
+	if len(sourceTexts) == 0 {
+		return result, nil
+	}
+
+	args := []any{key.SourceLanguage, key.TargetLanguage, key.Model, key.PromptVersion}
+	placeholders := make([]string, len(sourceTexts))
+	for i, text := range sourceTexts {
+		placeholders[i] = "?"
+		args = append(args, text)
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT source_text, translation
+		FROM translation_memory
+		WHERE source_language = ? AND target_language = ? AND model = ? AND prompt_version = ?
+		  AND source_text IN (`+strings.Join(placeholders, ", ")+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query translation memory: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sourceText, translation string
+		if err := rows.Scan(&sourceText, &translation); err != nil {
+			return nil, fmt.Errorf("failed to scan translation memory row: %v", err)
+		}
+		var lines []Line
+		if err := json.Unmarshal([]byte(translation), &lines); err != nil {
+			// Skip entries that cannot be decoded, they will be replaced
+			continue
+		}
+		result[sourceText] = lines
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating translation memory rows: %v", err)
+	}
+
+	return result, nil
+}
+
+// StoreTranslations caches translations keyed by normalized source text
+func (db *DB) StoreTranslations(key TranslationMemoryKey, translations map[string][]Line) error {
+	if len(translations) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	insert, err := tx.Prepare(`
+		INSERT OR REPLACE INTO translation_memory (
+			source_text, source_language, target_language, model,
+			prompt_version, translation, created_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare translation memory insert statement: %v", err)
+	}
+	defer insert.Close()
+
+	createdAt := time.Now().Unix()
+	for sourceText, lines := range translations {
+		var translation []byte
+		translation, err = json.Marshal(lines)
+		if err != nil {
+			return fmt.Errorf("failed to marshal translation: %v", err)
+		}
+
+		_, err = insert.Exec(sourceText, key.SourceLanguage, key.TargetLanguage,
+			key.Model, key.PromptVersion, string(translation), createdAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert translation: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
 // Helper functions for SQL NULL handling
 func sqlNullString(s string) sql.NullString {
 	if s == "" {
@@ -407,7 +784,7 @@ func nullStringValue(s sql.NullString) string {
 
 // FindMediaFilesWithCache tries to retrieve media files from cache first,
 // then falls back to the filesystem if needed
-func FindMediaFilesWithCache(db *DB, dirPath string) ([]GroupedMediaFile, error) {
+func FindMediaFilesWithCache(ctx context.Context, db *DB, dirPath string) ([]GroupedMediaFile, error) {
 	// Try to get from cache first
 	cachedFiles, err := db.GetCachedMediaFiles(dirPath)
 	if err != nil {
@@ -420,7 +797,7 @@ func FindMediaFilesWithCache(db *DB, dirPath string) ([]GroupedMediaFile, error)
 	}
 
 	// Otherwise, scan the filesystem
-	mediaFiles, err := FindMediaFiles(dirPath, nil)
+	mediaFiles, err := FindMediaFiles(ctx, dirPath, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -437,9 +814,9 @@ func FindMediaFilesWithCache(db *DB, dirPath string) ([]GroupedMediaFile, error)
 }
 
 // RefreshMediaFilesCache rescans the directory and updates the cache
-func RefreshMediaFilesCache(db *DB, dirPath string) ([]GroupedMediaFile, error) {
+func RefreshMediaFilesCache(ctx context.Context, db *DB, dirPath string) ([]GroupedMediaFile, error) {
 	// Scan the filesystem
-	mediaFiles, err := FindMediaFiles(dirPath, nil)
+	mediaFiles, err := FindMediaFiles(ctx, dirPath, nil)
 	if err != nil {
 		return nil, err
 	}
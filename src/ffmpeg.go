@@ -2,28 +2,120 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 )
 
 // SubtitleTrack represents a subtitle track in an MKV file
 type SubtitleTrack struct {
-	Index    int
-	Language string
-	Format   string
-	Title    string
+	Index           int    `json:"track_index"`               // Position among the subtitle tracks of the file
+	StreamIndex     int    `json:"stream_index"`              // Index of the stream among all streams of the file
+	Language        string `json:"language"`                  // Language tag
+	Format          string `json:"format"`                    // Codec name, such as subrip, ass or hdmv_pgs_subtitle
+	CodecLongName   string `json:"codec_long_name,omitempty"` // Descriptive codec name
+	Title           string `json:"title,omitempty"`
+	Default         bool   `json:"default"`          // Track is played by default
+	Forced          bool   `json:"forced"`           // Track only covers foreign dialogue and signs
+	HearingImpaired bool   `json:"hearing_impaired"` // Track is for the deaf and hard of hearing (SDH)
+	Comment         bool   `json:"comment"`          // Track is a commentary
+	Frames          int    `json:"frames,omitempty"` // Number of subtitle frames, 0 if unknown
+	Text            bool   `json:"text"`             // Track holds text rather than images
+}
+
+// textSubtitleCodecs are the subtitle codecs storing text, which can be
+// converted to SRT or ASS. Other codecs, such as hdmv_pgs_subtitle or
+// dvd_subtitle, store images.
+var textSubtitleCodecs = map[string]bool{
+	"ass":        true,
+	"ssa":        true,
+	"subrip":     true,
+	"srt":        true,
+	"webvtt":     true,
+	"mov_text":   true,
+	"text":       true,
+	"microdvd":   true,
+	"mpl2":       true,
+	"pjs":        true,
+	"realtext":   true,
+	"sami":       true,
+	"stl":        true,
+	"subviewer":  true,
+	"subviewer1": true,
+	"vplayer":    true,
+	"jacosub":    true,
+	"ttml":       true,
+	"eia_608":    true,
+}
+
+// isTextSubtitleCodec reports whether a subtitle codec stores text
+func isTextSubtitleCodec(codec string) bool {
+	return textSubtitleCodecs[strings.ToLower(codec)]
+}
+
+// ErrTrackNotFound is returned for a subtitle track index the file lacks
+var ErrTrackNotFound = errors.New("subtitle track not found")
+
+// BitmapSubtitleError reports a subtitle track storing images, such as PGS
+// or VobSub, which cannot be converted to text for translation
+type BitmapSubtitleError struct {
+	Path       string
+	TrackIndex int
+	Codec      string
+}
+
+func (e *BitmapSubtitleError) Error() string {
+	return fmt.Sprintf("subtitle track %d of '%s' is image-based (%s) and cannot be translated, choose a text track",
+		e.TrackIndex, e.Path, e.Codec)
+}
+
+// TextSubtitleTrack returns a subtitle track of a media file, or a
+// *BitmapSubtitleError if the track stores images
+func (ff *FFmpeg) TextSubtitleTrack(ctx context.Context, mediaPath string, trackIndex int) (SubtitleTrack, error) {
+	tracks, err := ff.ListSubtitleTracks(ctx, mediaPath)
+	if err != nil {
+		return SubtitleTrack{}, err
+	}
+	if trackIndex < 0 || trackIndex >= len(tracks) {
+		return SubtitleTrack{}, fmt.Errorf("%w: index %d (file has %d tracks)", ErrTrackNotFound, trackIndex, len(tracks))
+	}
+
+	track := tracks[trackIndex]
+	if !track.Text {
+		return track, &BitmapSubtitleError{Path: mediaPath, TrackIndex: trackIndex, Codec: track.Format}
+	}
+	return track, nil
 }
 
 // FFmpeg encapsulates ffmpeg functionality
 type FFmpeg struct {
 	Path      string // Path to the ffmpeg executable
+	ProbePath string // Path to the ffprobe executable
 	LogOutput bool   // Whether to print command output to console
 }
 
+// findFFprobe returns the path of the ffprobe executable installed next to
+// ffmpeg, or found in PATH
+func findFFprobe(ffmpegPath string) (string, error) {
+	path := filepath.Join(filepath.Dir(ffmpegPath), "ffprobe"+filepath.Ext(ffmpegPath))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	path, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return "", fmt.Errorf("ffprobe not found next to %s or in PATH: %v", ffmpegPath, err)
+	}
+	return path, nil
+}
+
 // NewFFmpeg creates a new FFmpeg instance
 func NewFFmpeg() (*FFmpeg, error) {
 	path, err := exec.LookPath("ffmpeg")
@@ -54,8 +146,14 @@ func NewFFmpeg() (*FFmpeg, error) {
 		return nil, fmt.Errorf("failed to execute ffmpeg: %v", err)
 	}
 
+	probePath, err := findFFprobe(path)
+	if err != nil {
+		return nil, err
+	}
+
 	return &FFmpeg{
 		Path:      path,
+		ProbePath: probePath,
 		LogOutput: false, // Default to not logging output
 	}, nil
 }
@@ -91,8 +189,14 @@ func NewFFmpegWithPath(path string) (*FFmpeg, error) {
 		return nil, fmt.Errorf("failed to execute ffmpeg at %s: %v", path, err)
 	}
 
+	probePath, err := findFFprobe(path)
+	if err != nil {
+		return nil, err
+	}
+
 	return &FFmpeg{
 		Path:      path,
+		ProbePath: probePath,
 		LogOutput: false, // Don't log output by default
 	}, nil
 }
@@ -104,6 +208,12 @@ func (ff *FFmpeg) SetLogOutput(logOutput bool) {
 
 // RunCommand executes an ffmpeg command and captures its output
 func (ff *FFmpeg) RunCommand(args ...string) (string, string, error) {
+	return ff.RunCommandContext(context.Background(), args...)
+}
+
+// RunCommandContext executes an ffmpeg command and captures its output,
+// killing the process if the context is cancelled
+func (ff *FFmpeg) RunCommandContext(ctx context.Context, args ...string) (string, string, error) {
 	if ff.Path == "" {
 		return "", "", fmt.Errorf("ffmpeg path is not set")
 	}
@@ -113,12 +223,7 @@ func (ff *FFmpeg) RunCommand(args ...string) (string, string, error) {
 		return "", "", fmt.Errorf("ffmpeg executable not found at %s", ff.Path)
 	}
 
-	cmd := exec.Command(ff.Path, args...)
-
-	// Create context with timeout if needed
-	// ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	// defer cancel()
-	// cmd = exec.CommandContext(ctx, ff.Path, args...)
+	cmd := exec.CommandContext(ctx, ff.Path, args...)
 
 	// Log the command being executed for debugging
 	slog.Debug("Executing FFmpeg command", "command", ff.Path, "args", strings.Join(args, " "))
@@ -191,6 +296,10 @@ func (ff *FFmpeg) RunCommand(args ...string) (string, string, error) {
 	<-stdoutDone
 	<-stderrDone
 
+	if ctx.Err() != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("ffmpeg was stopped: %w", ctx.Err())
+	}
+
 	// Parse specific errors from stderr
 	stderrStr := stderr.String()
 	if err != nil && stderrStr != "" {
@@ -208,98 +317,150 @@ func (ff *FFmpeg) RunCommand(args ...string) (string, string, error) {
 	return stdout.String(), stderrStr, err
 }
 
+// RunProbe executes an ffprobe command and returns its standard output,
+// killing the process if the context is cancelled
+func (ff *FFmpeg) RunProbe(ctx context.Context, args ...string) ([]byte, error) {
+	if ff.ProbePath == "" {
+		return nil, fmt.Errorf("ffprobe path is not set")
+	}
+
+	slog.Debug("Executing FFprobe command", "command", ff.ProbePath, "args", strings.Join(args, " "))
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ff.ProbePath, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("ffprobe was stopped: %w", ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout, nil
+}
+
 // ListSubtitleTracks lists all subtitle tracks in a media file
-func (ff *FFmpeg) ListSubtitleTracks(mediaPath string) ([]SubtitleTrack, error) {
+func (ff *FFmpeg) ListSubtitleTracks(ctx context.Context, mediaPath string) ([]SubtitleTrack, error) {
 	// Check if the media file exists
 	if _, err := os.Stat(mediaPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("media file does not exist: %s", mediaPath)
 	}
 
-	// Run ffmpeg to get information about the media file
-	_, stderr, err := ff.RunCommand("-i", mediaPath)
+	output, err := ff.RunProbe(ctx,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-select_streams", "s",
+		mediaPath,
+	)
 	if err != nil {
-		// Don't return an error here as ffmpeg returns non-zero when used with -i flag alone
-		// We just need the output for parsing
-		if !strings.Contains(stderr, "Input #0") {
-			return nil, fmt.Errorf("failed to get media info: %v", err)
-		}
+		return nil, fmt.Errorf("failed to get media info: %w", err)
 	}
 
-	// Parse the output to find subtitle tracks
-	lines := strings.Split(stderr, "\n")
+	tracks, err := parseProbeStreams(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return tracks, fmt.Errorf("no subtitle tracks found in the media file: %s", mediaPath)
+	}
 
-	var tracks []SubtitleTrack
-	trackIndex := 0
+	return tracks, nil
+}
 
-	//var lastSubtitleIdx = -1
-	for i := 0; i < len(lines); i++ {
-		line := lines[i]
-		if strings.Contains(line, "Stream") && strings.Contains(line, "Subtitle") {
-			// Example: Stream #0:2(eng): Subtitle: subrip
-			track := SubtitleTrack{
-				Index: trackIndex,
-			}
+// probeOutput is the part of the ffprobe JSON output describing streams
+type probeOutput struct {
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecName     string            `json:"codec_name"`
+		CodecLongName string            `json:"codec_long_name"`
+		NbFrames      string            `json:"nb_frames"`
+		Disposition   map[string]int    `json:"disposition"`
+		Tags          map[string]string `json:"tags"`
+	} `json:"streams"`
+}
 
-			// Extract language
-			if langStart := strings.Index(line, "("); langStart != -1 {
-				if langEnd := strings.Index(line[langStart:], ")"); langEnd != -1 {
-					track.Language = line[langStart+1 : langStart+langEnd]
-				}
-			}
+// parseProbeStreams converts the JSON output of ffprobe run on the subtitle
+// streams of a file to subtitle tracks, numbered in stream order
+func parseProbeStreams(data []byte) ([]SubtitleTrack, error) {
+	var output probeOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
 
-			// Extract format
-			if formatStart := strings.Index(line, "Subtitle: "); formatStart != -1 {
-				restOfLine := line[formatStart+10:]        // Skip "Subtitle: "
-				restOfLine = strings.TrimSpace(restOfLine) // Trim leading spaces
-				for j, char := range restOfLine {
-					if char == ' ' || char == '(' {
-						track.Format = restOfLine[:j]
-						break
-					}
-				}
-				// If no space or parenthesis is found, use the entire remaining string
-				if track.Format == "" {
-					track.Format = restOfLine
-				}
-			}
+	tracks := make([]SubtitleTrack, 0, len(output.Streams))
+	for i, stream := range output.Streams {
+		track := SubtitleTrack{
+			Index:           i,
+			StreamIndex:     stream.Index,
+			Language:        probeTag(stream.Tags, "language"),
+			Format:          stream.CodecName,
+			CodecLongName:   stream.CodecLongName,
+			Title:           probeTag(stream.Tags, "title"),
+			Default:         stream.Disposition["default"] != 0,
+			Forced:          stream.Disposition["forced"] != 0,
+			HearingImpaired: stream.Disposition["hearing_impaired"] != 0,
+			Comment:         stream.Disposition["comment"] != 0,
+			Frames:          probeCount(stream.NbFrames, probeTag(stream.Tags, "NUMBER_OF_FRAMES")),
+			Text:            isTextSubtitleCodec(stream.CodecName),
+		}
 
-			// Look ahead for Metadata and title
-			if i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == "Metadata:" {
-				i++ // move to Metadata:
-				for i+1 < len(lines) && (strings.HasPrefix(lines[i+1], "      ") || strings.HasPrefix(lines[i+1], "\t")) {
-					metaLine := strings.TrimSpace(lines[i+1])
-					if strings.HasPrefix(metaLine, "title") {
-						// metaLine is like "title           : English"
-						if colonIdx := strings.Index(metaLine, ":"); colonIdx != -1 {
-							track.Title = strings.TrimSpace(metaLine[colonIdx+1:])
-						}
-					}
-					i++
-				}
-			}
+		// If language is still empty, try to infer from title
+		if track.Language == "" && track.Title != "" {
+			track.Language = normalizeLanguageCode(track.Title)
+		}
 
-			// If language is still empty, try to infer from title
-			if track.Language == "" && track.Title != "" {
-				track.Language = normalizeLanguageCode(track.Title)
-			}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
 
-			//slog.Debug("Parsed subtitle track", "index", track.Index, "language", track.Language, "format", track.Format, "title", track.Title)
-			tracks = append(tracks, track)
-			trackIndex++
+// probeTag returns a stream tag, ignoring case. Matroska statistics tags may
+// carry a language suffix, such as NUMBER_OF_FRAMES-eng, which is accepted too.
+func probeTag(tags map[string]string, name string) string {
+	for key, value := range tags {
+		if strings.EqualFold(key, name) || strings.HasPrefix(strings.ToUpper(key), strings.ToUpper(name)+"-") {
+			return value
 		}
 	}
+	return ""
+}
 
-	if len(tracks) == 0 {
-		return tracks, fmt.Errorf("no subtitle tracks found in the media file: %s", mediaPath)
+// probeCount returns the first of the given counts that is a number, or 0
+func probeCount(values ...string) int {
+	for _, value := range values {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
 	}
+	return 0
+}
 
-	return tracks, nil
+// nativeSubtitleFormat returns the format a subtitle track should be
+// extracted to: ASS for ASS and SSA tracks, so that styles, positioning and
+// karaoke survive, and SRT for everything else
+func nativeSubtitleFormat(codec string) string {
+	switch strings.ToLower(codec) {
+	case "ass", "ssa":
+		return "ass"
+	default:
+		return "srt"
+	}
+}
+
+// extractedSubtitlePath returns the path ExtractSubtitleTrack writes a track
+// to: next to the media file, named after it and the language of the track
+func extractedSubtitlePath(mediaPath string, outputFormat string, langCode string) string {
+	baseFilename := filepath.Base(mediaPath)
+	baseFilename = strings.TrimSuffix(baseFilename, filepath.Ext(baseFilename))
+	return filepath.Join(filepath.Dir(mediaPath), fmt.Sprintf("%s.%s.%s", baseFilename, langCode, outputFormat))
 }
 
 // ExtractSubtitleTrack extracts a subtitle track from a media file
 // trackIndex is the index of the track to extract (0 for first subtitle track)
 // outputFormat should be "srt" or "ass"
-func (ff *FFmpeg) ExtractSubtitleTrack(mediaPath string, trackIndex int, outputFormat string, langCode string) (string, error) {
+// The ffmpeg process is killed if the context is cancelled.
+func (ff *FFmpeg) ExtractSubtitleTrack(ctx context.Context, mediaPath string, trackIndex int, outputFormat string, langCode string) (string, error) {
 	// Validate input parameters
 	if mediaPath == "" {
 		return "", fmt.Errorf("media path cannot be empty")
@@ -321,10 +482,8 @@ func (ff *FFmpeg) ExtractSubtitleTrack(mediaPath string, trackIndex int, outputF
 	}
 
 	// Create output filename based on input filename and language code
-	baseFilename := filepath.Base(mediaPath)
-	baseFilename = strings.TrimSuffix(baseFilename, filepath.Ext(baseFilename))
-	outputDir := filepath.Dir(mediaPath) // Get the directory of the input file
-	outputPath := filepath.Join(outputDir, fmt.Sprintf("%s.%s.%s", baseFilename, langCode, outputFormat))
+	outputPath := extractedSubtitlePath(mediaPath, outputFormat, langCode)
+	outputDir := filepath.Dir(outputPath)
 
 	// Ensure output directory exists
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -332,7 +491,7 @@ func (ff *FFmpeg) ExtractSubtitleTrack(mediaPath string, trackIndex int, outputF
 	}
 
 	// Run ffmpeg to extract subtitle
-	_, stderr, err := ff.RunCommand(
+	_, stderr, err := ff.RunCommandContext(ctx,
 		"-y", "-i", mediaPath,
 		"-map", fmt.Sprintf("0:s:%d", trackIndex),
 		"-c:s", outputFormat,
@@ -340,10 +499,17 @@ func (ff *FFmpeg) ExtractSubtitleTrack(mediaPath string, trackIndex int, outputF
 	)
 
 	if err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
 		// Check if the error is due to the track index being out of range
 		if strings.Contains(stderr, "Invalid stream specifier") {
 			return "", fmt.Errorf("invalid subtitle track index %d: %v", trackIndex, err)
 		}
+		// Check if the track stores images, which ffmpeg cannot convert to text
+		if strings.Contains(stderr, "only possible from text to text or bitmap to bitmap") {
+			return "", &BitmapSubtitleError{Path: mediaPath, TrackIndex: trackIndex, Codec: "bitmap"}
+		}
 		// Check if it failed to write the output file
 		if strings.Contains(stderr, "Permission denied") {
 			return "", fmt.Errorf("permission denied when writing to %s: %v", outputPath, err)
@@ -358,3 +524,123 @@ func (ff *FFmpeg) ExtractSubtitleTrack(mediaPath string, trackIndex int, outputF
 
 	return outputPath, nil
 }
+
+// MuxedSubtitle is a subtitle file added to a media file as a new track
+type MuxedSubtitle struct {
+	Path     string // Subtitle file to add
+	Language string // ISO 639-2 language tag of the track
+	Title    string // Title of the track
+	Default  bool   // Mark the track as default
+}
+
+// muxSubtitleCodec returns the codec subtitles are stored with in a
+// container: copied as they are in Matroska, converted to mov_text in MP4
+func muxSubtitleCodec(outputPath string) (string, error) {
+	switch strings.ToLower(filepath.Ext(outputPath)) {
+	case ".mkv", ".mka", ".mks":
+		return "copy", nil
+	case ".mp4", ".m4v", ".mov":
+		return "mov_text", nil
+	default:
+		return "", fmt.Errorf("cannot add subtitle tracks to '%s', only MKV and MP4 files are supported", outputPath)
+	}
+}
+
+// muxArgs builds the ffmpeg arguments copying all streams of a media file
+// and adding the subtitles after its existing subtitle tracks. Existing
+// tracks with the title and language of an added one, left by an earlier
+// run, are replaced, and when an added track is default the existing ones
+// stop being default.
+func muxArgs(mediaPath string, outputPath string, existing []SubtitleTrack, subtitles []MuxedSubtitle) ([]string, error) {
+	codec, err := muxSubtitleCodec(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-y", "-i", mediaPath}
+	for _, subtitle := range subtitles {
+		args = append(args, "-i", subtitle.Path)
+	}
+	args = append(args, "-map", "0")
+
+	var kept []SubtitleTrack
+	for _, track := range existing {
+		if slices.ContainsFunc(subtitles, track.isMuxedAs) {
+			args = append(args, "-map", fmt.Sprintf("-0:s:%d", track.Index))
+		} else {
+			kept = append(kept, track)
+		}
+	}
+	for i := range subtitles {
+		args = append(args, "-map", fmt.Sprintf("%d:s:0", i+1))
+	}
+	args = append(args, "-c", "copy")
+
+	if slices.ContainsFunc(subtitles, func(subtitle MuxedSubtitle) bool { return subtitle.Default }) {
+		for i, track := range kept {
+			if track.Default {
+				args = append(args, fmt.Sprintf("-disposition:s:%d", i), track.dispositionWithoutDefault())
+			}
+		}
+	}
+
+	for i, subtitle := range subtitles {
+		stream := fmt.Sprintf("s:%d", len(kept)+i)
+		disposition := "0"
+		if subtitle.Default {
+			disposition = "default"
+		}
+		args = append(args,
+			"-c:"+stream, codec,
+			"-metadata:s:"+stream, "language="+subtitle.Language,
+			"-metadata:s:"+stream, "title="+subtitle.Title,
+			"-disposition:"+stream, disposition,
+		)
+	}
+	return append(args, outputPath), nil
+}
+
+// isMuxedAs reports whether the track has the title and language of a
+// subtitle added to the media file
+func (t SubtitleTrack) isMuxedAs(subtitle MuxedSubtitle) bool {
+	return t.Title == subtitle.Title && strings.EqualFold(t.Language, subtitle.Language)
+}
+
+// dispositionWithoutDefault returns the ffmpeg disposition of the track
+// with the default flag cleared
+func (t SubtitleTrack) dispositionWithoutDefault() string {
+	var flags []string
+	if t.Forced {
+		flags = append(flags, "forced")
+	}
+	if t.HearingImpaired {
+		flags = append(flags, "hearing_impaired")
+	}
+	if t.Comment {
+		flags = append(flags, "comment")
+	}
+	if len(flags) == 0 {
+		return "0"
+	}
+	return strings.Join(flags, "+")
+}
+
+// MuxSubtitles writes a copy of a media file with the subtitle files added
+// as new tracks after its existing subtitle tracks, as described by
+// muxArgs. Streams are copied without re-encoding. The ffmpeg process is
+// killed if the context is cancelled.
+func (ff *FFmpeg) MuxSubtitles(ctx context.Context, mediaPath string, outputPath string, existing []SubtitleTrack, subtitles []MuxedSubtitle) error {
+	args, err := muxArgs(mediaPath, outputPath, existing, subtitles)
+	if err != nil {
+		return err
+	}
+
+	_, stderr, err := ff.RunCommandContext(ctx, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("failed to add subtitles to '%s': %v\nffmpeg error: %s", mediaPath, err, stderr)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -136,24 +137,6 @@ func DetectFileType(filePath string) (FileType, error) {
 	return FileTypeUnknown, nil
 }
 
-// FindFirstEnglishSubtitleTrack finds the first English subtitle track in a video file
-func FindFirstEnglishSubtitleTrack(tracks []SubtitleTrack) int {
-	for i, track := range tracks {
-		// Check for English language codes
-		lang := strings.ToLower(track.Language)
-		if lang == "eng" || lang == "en" || lang == "english" {
-			return i
-		}
-	}
-
-	// If no English track found, return the first track (if any)
-	if len(tracks) > 0 {
-		return 0
-	}
-
-	return -1 // No tracks found
-}
-
 // isNumeric checks if a string contains only numeric characters
 func isNumeric(s string) bool {
 	s = strings.TrimSpace(s)
@@ -180,13 +163,33 @@ type MediaFile struct {
 
 // SubtitleInfo represents information about a subtitle track
 type SubtitleInfo struct {
-	Path         string `json:"path,omitempty"`
-	TrackIndex   int    `json:"track_index"`
-	Language     string `json:"language"`
-	Format       string `json:"format"`
-	Embedded     bool   `json:"embedded"`
-	SubtitleType string `json:"type,omitempty"`
-	Title        string `json:"title,omitempty"`
+	Path            string `json:"path,omitempty"`
+	TrackIndex      int    `json:"track_index"`
+	StreamIndex     *int   `json:"stream_index,omitempty"` // Absolute stream index of embedded tracks
+	Language        string `json:"language"`
+	Format          string `json:"format"`
+	CodecLongName   string `json:"codec_long_name,omitempty"`
+	Embedded        bool   `json:"embedded"`
+	SubtitleType    string `json:"type,omitempty"`
+	Title           string `json:"title,omitempty"`
+	Default         bool   `json:"default"`
+	Forced          bool   `json:"forced"`
+	HearingImpaired bool   `json:"hearing_impaired"`
+	Comment         bool   `json:"comment"`
+	Text            bool   `json:"text"` // Subtitles are text rather than images
+}
+
+// subtitleTypeDispositions returns whether a subtitle type found in a file
+// name or track language marks forced or hearing impaired subtitles
+func subtitleTypeDispositions(subType string) (forced bool, hearingImpaired bool) {
+	switch subType {
+	case nonLanguageTags["forced"]:
+		return true, false
+	case nonLanguageTags["hi"], nonLanguageTags["cc"], nonLanguageTags["sdh"],
+		nonLanguageTags["deaf"], nonLanguageTags["hoh"]:
+		return false, true
+	}
+	return false, false
 }
 
 // GroupedMediaFile represents a video file with its related subtitle files
@@ -198,7 +201,7 @@ type GroupedMediaFile struct {
 
 // FindMediaFiles recursively scans a directory for media files (videos and subtitles)
 // and returns a list of grouped media files (videos with their associated subtitles)
-func FindMediaFiles(dirPath string, currentCached []GroupedMediaFile) ([]GroupedMediaFile, error) {
+func FindMediaFiles(ctx context.Context, dirPath string, currentCached []GroupedMediaFile) ([]GroupedMediaFile, error) {
 	if currentCached == nil {
 		currentCached = []GroupedMediaFile{}
 	}
@@ -253,7 +256,43 @@ func FindMediaFiles(dirPath string, currentCached []GroupedMediaFile) ([]Grouped
 	}
 
 	// Group media files by directory, including embedded subtitles
-	return groupMediaFilesByDirectory(dirMap, ff, currentCached), nil
+	return groupMediaFilesByDirectory(ctx, dirMap, ff, currentCached), nil
+}
+
+// FindVideoSubtitles returns the embedded subtitle tracks of a video and the
+// subtitle files next to it that belong to the video
+func FindVideoSubtitles(ctx context.Context, ff *FFmpeg, videoPath string) ([]SubtitleInfo, error) {
+	videoType, err := DetectFileType(videoPath)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting file type: %v", err)
+	}
+
+	dir := filepath.Dir(videoPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %v", dir, err)
+	}
+
+	// Only the video itself is probed, other videos in the directory are skipped
+	files := []MediaFile{{Path: videoPath, Type: videoType.String(), FileType: videoType}}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		fileType, err := DetectFileType(path)
+		if err != nil || !fileType.IsSubtitle() {
+			continue
+		}
+		files = append(files, MediaFile{Path: path, Type: fileType.String(), FileType: fileType})
+	}
+
+	for _, group := range groupMediaFilesByDirectory(ctx, map[string][]MediaFile{dir: files}, ff, nil) {
+		if group.VideoFile == videoPath {
+			return group.Subtitles, nil
+		}
+	}
+	return nil, nil
 }
 
 func findMediaPath(files []GroupedMediaFile, path string) (GroupedMediaFile, bool) {
@@ -267,7 +306,7 @@ func findMediaPath(files []GroupedMediaFile, path string) (GroupedMediaFile, boo
 
 // groupMediaFilesByDirectory groups subtitle files with video files based on directory
 // and also detects embedded subtitles in video files using FFmpeg
-func groupMediaFilesByDirectory(dirMap map[string][]MediaFile, ff *FFmpeg, currentCached []GroupedMediaFile) []GroupedMediaFile {
+func groupMediaFilesByDirectory(ctx context.Context, dirMap map[string][]MediaFile, ff *FFmpeg, currentCached []GroupedMediaFile) []GroupedMediaFile {
 	if currentCached == nil {
 		currentCached = []GroupedMediaFile{}
 	}
@@ -328,13 +367,18 @@ func groupMediaFilesByDirectory(dirMap map[string][]MediaFile, ff *FFmpeg, curre
 				for _, subtitleFile := range matchingSubs {
 					language, subType := determineLanguageAndTypeFromFilename(subtitleFile.Path)
 					langCode := normalizeLanguageCode(language)
+					format := getSubtitleFormat(subtitleFile.FileType)
+					forced, hearingImpaired := subtitleTypeDispositions(subType)
 					subtitleInfos = append(subtitleInfos, SubtitleInfo{
-						Path:         subtitleFile.Path,
-						Language:     langCode,
-						Format:       getSubtitleFormat(subtitleFile.FileType),
-						Embedded:     false,
-						SubtitleType: subType,
-						Title:        languageFullName(langCode),
+						Path:            subtitleFile.Path,
+						Language:        langCode,
+						Format:          format,
+						Embedded:        false,
+						SubtitleType:    subType,
+						Title:           languageFullName(langCode),
+						Forced:          forced,
+						HearingImpaired: hearingImpaired,
+						Text:            isTextSubtitleCodec(format),
 					})
 				}
 				// check if ffmpeg needs to be used
@@ -353,7 +397,7 @@ func groupMediaFilesByDirectory(dirMap map[string][]MediaFile, ff *FFmpeg, curre
 				}
 				if probe {
 					// Check for embedded subtitles in the video file
-					embeddedTracks, err := ff.ListSubtitleTracks(videoFile.Path)
+					embeddedTracks, err := ff.ListSubtitleTracks(ctx, videoFile.Path)
 					if err == nil {
 						for _, track := range embeddedTracks {
 							subType := ""
@@ -367,13 +411,21 @@ func groupMediaFilesByDirectory(dirMap map[string][]MediaFile, ff *FFmpeg, curre
 							if title == "" {
 								title = languageFullName(langCode)
 							}
+							forced, hearingImpaired := subtitleTypeDispositions(subType)
 							subtitleInfos = append(subtitleInfos, SubtitleInfo{
-								TrackIndex:   track.Index,
-								Language:     langCode,
-								Format:       track.Format,
-								Embedded:     true,
-								SubtitleType: subType,
-								Title:        title,
+								TrackIndex:      track.Index,
+								StreamIndex:     &track.StreamIndex,
+								Language:        langCode,
+								Format:          track.Format,
+								CodecLongName:   track.CodecLongName,
+								Embedded:        true,
+								SubtitleType:    subType,
+								Title:           title,
+								Default:         track.Default,
+								Forced:          track.Forced || forced,
+								HearingImpaired: track.HearingImpaired || hearingImpaired,
+								Comment:         track.Comment,
+								Text:            track.Text,
 							})
 						}
 					}
@@ -391,13 +443,18 @@ func groupMediaFilesByDirectory(dirMap map[string][]MediaFile, ff *FFmpeg, curre
 			for _, subtitleFile := range subtitleFiles {
 				language, subType := determineLanguageAndTypeFromFilename(subtitleFile.Path)
 				langCode := normalizeLanguageCode(language)
+				format := getSubtitleFormat(subtitleFile.FileType)
+				forced, hearingImpaired := subtitleTypeDispositions(subType)
 				subtitleInfos = append(subtitleInfos, SubtitleInfo{
-					Path:         subtitleFile.Path,
-					Language:     langCode,
-					Format:       getSubtitleFormat(subtitleFile.FileType),
-					Embedded:     false,
-					SubtitleType: subType,
-					Title:        languageFullName(langCode),
+					Path:            subtitleFile.Path,
+					Language:        langCode,
+					Format:          format,
+					Embedded:        false,
+					SubtitleType:    subType,
+					Title:           languageFullName(langCode),
+					Forced:          forced,
+					HearingImpaired: hearingImpaired,
+					Text:            isTextSubtitleCodec(format),
 				})
 			}
 
@@ -705,6 +762,29 @@ func normalizeLanguageCode(code string) string {
 	return ""
 }
 
+// languageAlpha3Map maps ISO 639-1 codes to the ISO 639-2/B codes used to
+// tag tracks in media containers
+var languageAlpha3Map = map[string]string{
+	"en": "eng", "pl": "pol", "fr": "fre", "es": "spa", "de": "ger",
+	"it": "ita", "ja": "jpn", "ko": "kor", "zh": "chi", "ru": "rus",
+	"pt": "por", "tr": "tur", "nl": "dut", "sv": "swe", "fi": "fin",
+	"no": "nor", "da": "dan", "hu": "hun", "el": "gre", "cs": "cze",
+	"sk": "slo", "hr": "hrv", "sr": "srp", "bs": "bos", "sl": "slv",
+	"bg": "bul", "ro": "rum", "uk": "ukr", "he": "heb", "ar": "ara",
+	"hi": "hin", "bn": "ben", "ur": "urd", "fa": "per", "th": "tha",
+	"vi": "vie", "ms": "may", "id": "ind", "tl": "fil", "sw": "swa",
+	"af": "afr",
+}
+
+// languageAlpha3 returns the ISO 639-2/B code for an ISO 639-1 code, or the
+// code itself if it is not known
+func languageAlpha3(code string) string {
+	if alpha3, ok := languageAlpha3Map[code]; ok {
+		return alpha3
+	}
+	return code
+}
+
 // languageFullName returns the full language name for a given ISO 639-1 code
 func languageFullName(code string) string {
 	if name, ok := languageFullNameMap[code]; ok {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GlossaryFileName is the name of per-show glossary files, looked up in the
+// directory of the translated file and its parents up to the media path
+const GlossaryFileName = "aisubs-glossary.yaml"
+
+// GlossaryTerm is a term that must always be translated the same way
+type GlossaryTerm struct {
+	Source       string            `yaml:"source"`
+	Target       string            `yaml:"target"`       // Translation used for all languages
+	Translations map[string]string `yaml:"translations"` // Translations by ISO 639-1 code, preferred over Target
+	Note         string            `yaml:"note"`         // Hint for the model, e.g. grammatical gender
+}
+
+// Glossary holds the terminology of a media path or a show
+type Glossary struct {
+	Terms          []GlossaryTerm `yaml:"terms"`
+	Names          []string       `yaml:"names"`            // Character names, kept as they are
+	DoNotTranslate []string       `yaml:"do_not_translate"` // Other words kept as they are
+}
+
+// GlossaryEntry is a glossary term resolved for a single target language
+type GlossaryEntry struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Note   string `json:"note,omitempty"`
+}
+
+// GlossaryViolation reports a translated subtitle that does not use the
+// translation required by the glossary
+type GlossaryViolation struct {
+	Index    int    `json:"index"`
+	Term     string `json:"term"`
+	Expected string `json:"expected"`
+}
+
+// LoadGlossary reads a glossary from a YAML file
+func LoadGlossary(path string) (*Glossary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glossary file: %w", err)
+	}
+
+	var glossary Glossary
+	if err := yaml.Unmarshal(data, &glossary); err != nil {
+		return nil, fmt.Errorf("failed to parse glossary file %s: %w", path, err)
+	}
+	return &glossary, nil
+}
+
+// LoadGlossaryForFile combines the glossary of the media path containing the
+// file with the per-show glossary files found between the media path and the
+// file. Terms from files closer to the file take precedence.
+func LoadGlossaryForFile(filePath string) (*Glossary, error) {
+	var paths []string
+
+	// Collect glossary files from the file's directory upwards
+	dir := filepath.Dir(filePath)
+	_, mediaPath, inMediaPath := GetMediaPathForFile(filePath)
+	root := filepath.Clean(mediaPath.Path)
+	for {
+		candidate := filepath.Join(dir, GlossaryFileName)
+		if _, err := os.Stat(candidate); err == nil {
+			paths = append([]string{candidate}, paths...)
+		}
+		parent := filepath.Dir(dir)
+		if !inMediaPath || dir == root || parent == dir {
+			break
+		}
+		dir = parent
+	}
+	if inMediaPath && mediaPath.Glossary != "" {
+		paths = append([]string{mediaPath.Glossary}, paths...)
+	}
+
+	combined := &Glossary{}
+	for _, path := range paths {
+		glossary, err := LoadGlossary(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("Loaded glossary", "path", path, "terms", len(glossary.Terms))
+		combined.merge(glossary)
+	}
+	return combined, nil
+}
+
+// merge adds the entries of another glossary, replacing terms with the same source
+func (g *Glossary) merge(other *Glossary) {
+	for _, term := range other.Terms {
+		replaced := false
+		for i := range g.Terms {
+			if strings.EqualFold(g.Terms[i].Source, term.Source) {
+				g.Terms[i] = term
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			g.Terms = append(g.Terms, term)
+		}
+	}
+	g.Names = append(g.Names, other.Names...)
+	g.DoNotTranslate = append(g.DoNotTranslate, other.DoNotTranslate...)
+}
+
+// Entries resolves the glossary for a target language given as an ISO 639-1 code
+func (g *Glossary) Entries(langCode string) []GlossaryEntry {
+	if g == nil {
+		return nil
+	}
+
+	var entries []GlossaryEntry
+	for _, term := range g.Terms {
+		target := term.Translations[langCode]
+		if target == "" {
+			target = term.Target
+		}
+		if term.Source == "" || target == "" {
+			continue
+		}
+		entries = append(entries, GlossaryEntry{Source: term.Source, Target: target, Note: term.Note})
+	}
+	for _, name := range g.Names {
+		entries = append(entries, GlossaryEntry{Source: name, Target: name, Note: "character name"})
+	}
+	for _, word := range g.DoNotTranslate {
+		entries = append(entries, GlossaryEntry{Source: word, Target: word, Note: "do not translate"})
+	}
+	return entries
+}
+
+// relevantGlossaryEntries returns the entries whose source term appears in
+// any of the subtitles, so that only those are sent with a batch
+func relevantGlossaryEntries(entries []GlossaryEntry, subtitles ...[]Subtitle) []GlossaryEntry {
+	var relevant []GlossaryEntry
+	for _, entry := range entries {
+	search:
+		for _, subs := range subtitles {
+			for _, sub := range subs {
+				if containsTerm(subtitleText(sub), entry.Source, true) {
+					relevant = append(relevant, entry)
+					break search
+				}
+			}
+		}
+	}
+	return relevant
+}
+
+// checkGlossary reports translations that do not contain the required
+// translation of a glossary term used in the source subtitle
+func checkGlossary(entries []GlossaryEntry, source []Subtitle, translated []Subtitle) []GlossaryViolation {
+	translatedByIndex := make(map[int]Subtitle, len(translated))
+	for _, sub := range translated {
+		translatedByIndex[sub.Index] = sub
+	}
+
+	var violations []GlossaryViolation
+	for _, sub := range source {
+		translation, ok := translatedByIndex[sub.Index]
+		if !ok {
+			continue
+		}
+		sourceText := subtitleText(sub)
+		translatedText := subtitleText(translation)
+		for _, entry := range entries {
+			// Only the start of the word is checked, so that inflected
+			// forms (e.g. Kaladina in Polish) are accepted
+			if containsTerm(sourceText, entry.Source, true) && !containsTerm(translatedText, entry.Target, false) {
+				violations = append(violations, GlossaryViolation{
+					Index:    sub.Index,
+					Term:     entry.Source,
+					Expected: entry.Target,
+				})
+			}
+		}
+	}
+	return violations
+}
+
+// subtitleText joins the text of all lines of a subtitle
+func subtitleText(sub Subtitle) string {
+	var builder strings.Builder
+	for _, line := range sub.Lines {
+		for _, item := range line.Items {
+			builder.WriteString(item.Text)
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// containsTerm reports whether text contains term, ignoring case, starting at
+// a word boundary. If wholeWord is set the term must also end at one.
+func containsTerm(text, term string, wholeWord bool) bool {
+	text = strings.ToLower(text)
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return false
+	}
+
+	for offset := 0; offset < len(text); {
+		idx := strings.Index(text[offset:], term)
+		if idx == -1 {
+			return false
+		}
+		start := offset + idx
+		end := start + len(term)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !isWordRune(before)) && (!wholeWord || end == len(text) || !isWordRune(after)) {
+			return true
+		}
+		offset = start + 1
+	}
+	return false
+}
+
+// isWordRune reports whether r can be part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
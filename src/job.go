@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -54,60 +60,457 @@ const (
 	JobStatusFailed      JobStatus = "failed"
 	JobStatusExtracting  JobStatus = "extracting"
 	JobStatusTranslating JobStatus = "translating"
+	// JobStatusPartial indicates the output was written but some subtitles are untranslated
+	JobStatusPartial JobStatus = "partial"
+	// JobStatusCancelled indicates the job was cancelled before it finished
+	JobStatusCancelled JobStatus = "cancelled"
 )
 
+// ErrJobFinished is returned when cancelling a job that is no longer active
+var ErrJobFinished = errors.New("job already finished")
+
+// ErrJobNotRetryable is returned when retrying a job that did not fail
+var ErrJobNotRetryable = errors.New("only failed and partial jobs can be retried")
+
+// IsActive reports whether a job with this status has not finished yet
+func (s JobStatus) IsActive() bool {
+	switch s {
+	case JobStatusPending, JobStatusProcessing, JobStatusExtracting, JobStatusTranslating:
+		return true
+	default:
+		return false
+	}
+}
+
+// JobOutput represents the translation of a job into a single language.
+// A failed translation has no output path; a partial one has both an
+// output path and an error.
+type JobOutput struct {
+	Language            string `json:"language"`
+	OutputPath          string `json:"outputPath,omitempty"`
+	Error               string `json:"error,omitempty"`
+	UntranslatedIndices []int  `json:"untranslatedIndices,omitempty"`
+
+	GlossaryViolations []GlossaryViolation `json:"glossaryViolations,omitempty"`
+
+	MemoryHits   int `json:"memoryHits"`   // Subtitles taken from the translation memory
+	MemoryMisses int `json:"memoryMisses"` // Subtitles sent to the translation backend
+}
+
 // JobResult represents the result of a completed job
 type JobResult struct {
-	OutputPath string `json:"outputPath,omitempty"`
-	Error      string `json:"error,omitempty"`
+	OutputPath   string      `json:"outputPath,omitempty"`
+	Outputs      []JobOutput `json:"outputs,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	MemoryHits   int         `json:"memoryHits"`          // Translation memory hits of all outputs
+	MemoryMisses int         `json:"memoryMisses"`        // Translation memory misses of all outputs
+	MuxedPath    string      `json:"muxedPath,omitempty"` // Video the translations were added to as tracks
+	MuxError     string      `json:"muxError,omitempty"`  // Why the translations could not be added to the video
 }
 
 // Job represents a translation job
 type Job struct {
-	ID         string    `json:"id"`
-	Status     JobStatus `json:"status"`
-	Progress   float64   `json:"progress"`
-	Path       string    `json:"path"`
-	TrackIndex int       `json:"trackIndex"`
-	Result     JobResult `json:"result,omitempty"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	ID              string    `json:"id"`
+	Status          JobStatus `json:"status"`
+	Progress        float64   `json:"progress"`
+	Path            string    `json:"path"`
+	TrackIndex      int       `json:"trackIndex"`
+	TargetLanguages []string  `json:"targetLanguages"`
+	Priority        int       `json:"priority"`
+	Backend         string    `json:"backend,omitempty"` // Backend requested for the job, empty for the configured one
+	Result          JobResult `json:"result,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// JobRequest contains the parameters of a new translation job
+type JobRequest struct {
+	Path            string   // Video or subtitle file to translate
+	TrackIndex      int      // Subtitle track to use for video files
+	TargetLanguages []string // ISO 639-1 codes of the languages to translate into
+	Priority        int      // Jobs with higher priority are processed first
+	Backend         string   // Translation backend overriding the configured one, empty for none
+	Force           bool     // Create the job even if an equivalent one exists
+}
+
+// sharesInput reports whether the job translates the same input as the request
+func (j *Job) sharesInput(request JobRequest) bool {
+	return j.Path == request.Path && j.TrackIndex == request.TrackIndex
+}
+
+// coversLanguages reports whether the job translates into all given languages
+func (j *Job) coversLanguages(languages []string) bool {
+	for _, language := range languages {
+		if !slices.Contains(j.TargetLanguages, language) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeTargetLanguages converts language names or codes to unique
+// ISO 639-1 codes, falling back to the configured target language
+func normalizeTargetLanguages(languages []string) ([]string, error) {
+	if len(languages) == 0 {
+		languages = []string{GetTranslationConfig().TargetLanguage}
+	}
+
+	var codes []string
+	for _, language := range languages {
+		code := normalizeLanguageCode(language)
+		if code == "" {
+			return nil, fmt.Errorf("unknown target language '%s'", language)
+		}
+		if !slices.Contains(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
+}
+
+// Types of job events
+const (
+	// JobEventStatus is sent when a job is created or changes status
+	JobEventStatus = "status"
+	// JobEventProgress is sent when the progress of a job changes
+	JobEventProgress = "progress"
+)
+
+// JobEvent is sent to subscribers when a job changes
+type JobEvent struct {
+	Type string `json:"type"`
+	Job  Job    `json:"job"`
+}
+
+// jobSubscriber receives the events of one job, or of all jobs if jobID is empty
+type jobSubscriber struct {
+	jobID  string
+	events chan JobEvent
+}
+
+// JobFilter selects and orders the jobs returned by ListJobs
+type JobFilter struct {
+	Statuses      []JobStatus // Any of the statuses, all if empty
+	PathPrefix    string      // Paths starting with the prefix
+	MediaRoot     string      // Paths inside the directory, e.g. of a media path
+	CreatedAfter  time.Time   // Created at or after, if set
+	CreatedBefore time.Time   // Created before, if set
+
+	SortBy     string // created_at (default), updated_at, status, path, progress or priority
+	Descending bool
+
+	Offset int
+	Limit  int // Maximum number of jobs to return, 0 for all
+}
+
+// JobSortFields are the values accepted in JobFilter.SortBy
+var JobSortFields = []string{"created_at", "updated_at", "status", "path", "progress", "priority"}
+
+// matches reports whether a job passes the filter
+func (f JobFilter) matches(job *Job) bool {
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, job.Status) {
+		return false
+	}
+	if !strings.HasPrefix(job.Path, f.PathPrefix) {
+		return false
+	}
+	if f.MediaRoot != "" {
+		root := filepath.Clean(f.MediaRoot)
+		if job.Path != root && !strings.HasPrefix(job.Path, root+string(filepath.Separator)) {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() && job.CreatedAt.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !job.CreatedAt.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// less orders two jobs by the field the filter sorts by, ascending
+func (f JobFilter) less(a, b Job) bool {
+	switch f.SortBy {
+	case "updated_at":
+		return a.UpdatedAt.Before(b.UpdatedAt)
+	case "status":
+		return a.Status < b.Status
+	case "path":
+		return a.Path < b.Path
+	case "progress":
+		return a.Progress < b.Progress
+	case "priority":
+		return a.Priority < b.Priority
+	default:
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+}
+
+// JobStore persists jobs so that they survive restarts
+type JobStore interface {
+	// SaveJob stores the current state of a job
+	SaveJob(job Job) error
+	// LoadJobs returns all stored jobs
+	LoadJobs() ([]*Job, error)
+
+	// LoadCheckpoint returns the translations saved for a job and language
+	LoadCheckpoint(jobID, language string) ([]Subtitle, error)
+	// SaveCheckpoint adds translations to the checkpoint of a job and language
+	SaveCheckpoint(jobID, language string, translations []Subtitle) error
+	// DeleteCheckpoints removes all checkpoints of a job
+	DeleteCheckpoints(jobID string) error
 }
 
 // JobManager manages translation jobs
 type JobManager struct {
 	jobs  map[string]*Job
 	mutex sync.RWMutex
+	store JobStore
+	queue *JobQueue
+
+	// Cancel functions of the running jobs
+	cancels map[string]context.CancelFunc
+
+	subscribers map[*jobSubscriber]struct{}
+
+	// How long a completed job is returned for equivalent requests
+	duplicateWindow time.Duration
+
+	// Webhooks notified about created and finished jobs, none if nil
+	webhooks *WebhookDispatcher
+
+	// Jobs interrupted by the last shutdown, waiting to be restarted
+	interrupted []string
 }
 
-// NewJobManager creates a new job manager
+// NewJobManager creates a new job manager that keeps jobs in the database,
+// with the configured number of workers processing them
 func NewJobManager() *JobManager {
-	return &JobManager{
-		jobs: make(map[string]*Job),
+	config := GetJobsConfig()
+	jm := NewJobManagerWithStore(GetDB(), config.ResumeInterrupted)
+	jm.queue = NewJobQueue(config.QueueSize)
+	jm.duplicateWindow = config.DuplicateWindow
+	jm.webhooks = GetWebhookDispatcher()
+	jm.StartWorkers(config.Workers)
+	return jm
+}
+
+// NewJobManagerWithStore creates a new job manager that keeps jobs in the
+// given store, loading the jobs stored there. Jobs that were still running
+// are reset to pending if resumeInterrupted is set, or marked failed.
+func NewJobManagerWithStore(store JobStore, resumeInterrupted bool) *JobManager {
+	jm := &JobManager{
+		jobs:    make(map[string]*Job),
+		store:   store,
+		queue:   NewJobQueue(0),
+		cancels: make(map[string]context.CancelFunc),
+
+		subscribers: make(map[*jobSubscriber]struct{}),
+	}
+	if store == nil {
+		return jm
+	}
+
+	jobs, err := store.LoadJobs()
+	if err != nil {
+		slog.Error("Error loading stored jobs", "error", err)
+		return jm
+	}
+
+	for _, job := range jobs {
+		jm.jobs[job.ID] = job
+		if !job.Status.IsActive() {
+			continue
+		}
+
+		if resumeInterrupted {
+			slog.Info("Resuming interrupted job", "id", job.ID, "path", job.Path)
+			job.Status = JobStatusPending
+			job.Progress = 0.0
+			jm.interrupted = append(jm.interrupted, job.ID)
+		} else {
+			slog.Warn("Marking interrupted job as failed", "id", job.ID, "path", job.Path)
+			job.Status = JobStatusFailed
+			job.Result.Error = "interrupted by restart"
+		}
+		job.UpdatedAt = time.Now()
+		jm.persist(job)
+	}
+
+	return jm
+}
+
+// ResumeInterruptedJobs queues the jobs interrupted by the last shutdown again
+func (jm *JobManager) ResumeInterruptedJobs() {
+	jm.mutex.Lock()
+	interrupted := jm.interrupted
+	jm.interrupted = nil
+	jm.mutex.Unlock()
+
+	for _, id := range interrupted {
+		if err := jm.EnqueueJob(id); err != nil {
+			slog.Error("Error queuing interrupted job", "id", id, "error", err)
+			jm.SetJobError(id, fmt.Errorf("error queuing interrupted job: %w", err))
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events of the job with the given
+// ID, starting with its current state, or of all jobs if the ID is empty.
+// The returned function ends the subscription and closes the channel.
+func (jm *JobManager) Subscribe(jobID string) (<-chan JobEvent, func()) {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	subscriber := &jobSubscriber{jobID: jobID, events: make(chan JobEvent, 64)}
+	if job, exists := jm.jobs[jobID]; exists {
+		subscriber.events <- JobEvent{Type: JobEventStatus, Job: *job}
+	}
+	jm.subscribers[subscriber] = struct{}{}
+
+	unsubscribe := func() {
+		jm.mutex.Lock()
+		defer jm.mutex.Unlock()
+		if _, subscribed := jm.subscribers[subscriber]; subscribed {
+			delete(jm.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+	return subscriber.events, unsubscribe
+}
+
+// notify sends an event about a job to its subscribers. It must be called
+// with the mutex held. Events are dropped for subscribers that do not keep up.
+func (jm *JobManager) notify(job *Job, eventType string) {
+	for subscriber := range jm.subscribers {
+		if subscriber.jobID != "" && subscriber.jobID != job.ID {
+			continue
+		}
+		select {
+		case subscriber.events <- JobEvent{Type: eventType, Job: *job}:
+		default:
+			slog.Warn("Dropping job event for slow subscriber", "id", job.ID, "type", eventType)
+		}
+	}
+}
+
+// persist saves a job to the store. It must be called with the mutex held.
+// Failures are only logged, so that jobs keep running without a database.
+func (jm *JobManager) persist(job *Job) {
+	if jm.store == nil {
+		return
+	}
+	if err := jm.store.SaveJob(*job); err != nil {
+		slog.Warn("Error saving job", "id", job.ID, "error", err)
 	}
 }
 
-// CreateJob creates a new job with the given parameters
-func (jm *JobManager) CreateJob(path string, trackIndex int) *Job {
+// CreateJob creates a new job with the given parameters. Unless the request
+// is forced, an active or recently completed equivalent job is returned
+// instead, so that repeated requests do not translate and write the same
+// output twice. The second result reports whether a new job was created.
+func (jm *JobManager) CreateJob(request JobRequest) (*Job, bool) {
+	job, _, created := jm.CreateJobForLanguages(request)
+	return job, created
+}
+
+// CreateJobForLanguages works like CreateJob, but when other jobs already
+// translate some of the requested languages, the new job only translates
+// the others. The second result maps the requested languages translated by
+// jobs other than the returned one to the IDs of those jobs.
+func (jm *JobManager) CreateJobForLanguages(request JobRequest) (*Job, map[string]string, bool) {
 	jm.mutex.Lock()
 	defer jm.mutex.Unlock()
 
+	coveredBy := make(map[string]string)
+	if !request.Force {
+		existing, translatedBy := jm.findEquivalentJob(request)
+		var uncovered []string
+		for _, language := range request.TargetLanguages {
+			if job, found := translatedBy[language]; !found {
+				uncovered = append(uncovered, language)
+			} else if job != existing {
+				coveredBy[language] = job.ID
+			}
+		}
+		if existing != nil {
+			slog.Info("Returning equivalent job", "id", existing.ID, "path", request.Path)
+			return existing, coveredBy, false
+		}
+		if len(uncovered) < len(request.TargetLanguages) {
+			slog.Info("Creating job for languages not translated by other jobs",
+				"path", request.Path, "languages", uncovered)
+			request.TargetLanguages = uncovered
+		}
+	}
+
 	id := generateUUID()
 	now := time.Now()
 
 	job := &Job{
-		ID:         id,
-		Status:     JobStatusPending,
-		Progress:   0.0,
-		Path:       path,
-		TrackIndex: trackIndex,
-		Result:     JobResult{},
-		CreatedAt:  now,
-		UpdatedAt:  now,
+		ID:              id,
+		Status:          JobStatusPending,
+		Progress:        0.0,
+		Path:            request.Path,
+		TrackIndex:      request.TrackIndex,
+		TargetLanguages: request.TargetLanguages,
+		Priority:        request.Priority,
+		Backend:         request.Backend,
+		Result:          JobResult{},
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	}
 
 	jm.jobs[id] = job
-	return job
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+	jm.webhooks.DispatchJob(WebhookJobCreated, *job)
+	return job, coveredBy, true
+}
+
+// findEquivalentJob returns the newest active or recently completed job for
+// the same input translating into all requested languages, or if there is
+// none but such jobs translate into all of them together, the newest of
+// those. Otherwise it returns the newest such job translating into each of
+// the requested languages. It must be called with the mutex held.
+func (jm *JobManager) findEquivalentJob(request JobRequest) (*Job, map[string]*Job) {
+	var covering *Job
+	translatedBy := make(map[string]*Job)
+	for _, job := range jm.jobs {
+		if !job.sharesInput(request) {
+			continue
+		}
+		recent := job.Status == JobStatusCompleted && time.Since(job.UpdatedAt) < jm.duplicateWindow
+		if !job.Status.IsActive() && !recent {
+			continue
+		}
+
+		for _, language := range request.TargetLanguages {
+			newest, found := translatedBy[language]
+			if slices.Contains(job.TargetLanguages, language) && (!found || job.CreatedAt.After(newest.CreatedAt)) {
+				translatedBy[language] = job
+			}
+		}
+		if job.coversLanguages(request.TargetLanguages) &&
+			(covering == nil || job.CreatedAt.After(covering.CreatedAt)) {
+			covering = job
+		}
+	}
+	if covering != nil {
+		return covering, nil
+	}
+
+	if len(request.TargetLanguages) == 0 || len(translatedBy) < len(request.TargetLanguages) {
+		return nil, translatedBy
+	}
+	var newest *Job
+	for _, job := range translatedBy {
+		if newest == nil || job.CreatedAt.After(newest.CreatedAt) {
+			newest = job
+		}
+	}
+	return newest, translatedBy
 }
 
 // GetJob returns a job by its ID
@@ -123,6 +526,34 @@ func (jm *JobManager) GetJob(id string) (*Job, error) {
 	return job, nil
 }
 
+// ListJobs returns copies of the jobs passing the filter, sorted and
+// paginated as requested, together with the number of matching jobs
+func (jm *JobManager) ListJobs(filter JobFilter) ([]Job, int) {
+	jm.mutex.RLock()
+	var jobs []Job
+	for _, job := range jm.jobs {
+		if filter.matches(job) {
+			jobs = append(jobs, *job)
+		}
+	}
+	jm.mutex.RUnlock()
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if filter.Descending {
+			return filter.less(jobs[j], jobs[i])
+		}
+		return filter.less(jobs[i], jobs[j])
+	})
+
+	total := len(jobs)
+	start := min(max(filter.Offset, 0), total)
+	end := total
+	if filter.Limit > 0 {
+		end = min(start+filter.Limit, total)
+	}
+	return jobs[start:end], total
+}
+
 // UpdateJobStatus updates the status of a job
 func (jm *JobManager) UpdateJobStatus(id string, status JobStatus) error {
 	jm.mutex.Lock()
@@ -132,9 +563,14 @@ func (jm *JobManager) UpdateJobStatus(id string, status JobStatus) error {
 	if !exists {
 		return fmt.Errorf("job not found: %s", id)
 	}
+	if job.Status == JobStatusCancelled {
+		return nil
+	}
 
 	job.Status = status
 	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
 	return nil
 }
 
@@ -147,14 +583,23 @@ func (jm *JobManager) UpdateJobProgress(id string, progress float64) error {
 	if !exists {
 		return fmt.Errorf("job not found: %s", id)
 	}
+	if !job.Status.IsActive() {
+		// Late updates must not change the progress of a finished job
+		return nil
+	}
 
 	job.Progress = progress
 	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventProgress)
 	return nil
 }
 
-// SetJobResult sets the result of a completed job
-func (jm *JobManager) SetJobResult(id string, outputPath string) error {
+// SetJobResult sets the result of a finished job. The job is completed if
+// every language was translated, partial if some outputs are missing cues or
+// could not be added to the video, and failed if any translation could not
+// be written. Cancelled jobs stay cancelled.
+func (jm *JobManager) SetJobResult(id string, outputs []JobOutput) error {
 	jm.mutex.Lock()
 	defer jm.mutex.Unlock()
 
@@ -162,15 +607,83 @@ func (jm *JobManager) SetJobResult(id string, outputPath string) error {
 	if !exists {
 		return fmt.Errorf("job not found: %s", id)
 	}
+	if job.Status == JobStatusCancelled {
+		// Keep the outputs finished before the job was cancelled
+		job.Result.Outputs = outputs
+		job.UpdatedAt = time.Now()
+		jm.persist(job)
+		jm.notify(job, JobEventStatus)
+		return nil
+	}
 
 	job.Status = JobStatusCompleted
 	job.Progress = 100.0
-	job.Result.OutputPath = outputPath
+	job.Result.Outputs = outputs
+	job.Result.OutputPath = ""
+	job.Result.Error = ""
+	job.Result.MemoryHits = 0
+	job.Result.MemoryMisses = 0
+
+	var errs []string
+	for _, output := range outputs {
+		job.Result.MemoryHits += output.MemoryHits
+		job.Result.MemoryMisses += output.MemoryMisses
+		if job.Result.OutputPath == "" {
+			job.Result.OutputPath = output.OutputPath
+		}
+		if output.Error == "" {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", output.Language, output.Error))
+		if output.OutputPath == "" {
+			job.Status = JobStatusFailed
+		} else if job.Status != JobStatusFailed {
+			job.Status = JobStatusPartial
+		}
+	}
+	if job.Result.MuxError != "" {
+		// The subtitle files are usable even though the video has no tracks
+		errs = append(errs, "mux: "+job.Result.MuxError)
+		if job.Status == JobStatusCompleted {
+			job.Status = JobStatusPartial
+		}
+	}
+	job.Result.Error = strings.Join(errs, "; ")
+
 	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+	if job.Status == JobStatusFailed {
+		jm.webhooks.DispatchJob(WebhookJobFailed, *job)
+	} else {
+		jm.webhooks.DispatchJob(WebhookJobCompleted, *job)
+	}
 	return nil
 }
 
-// SetJobError sets an error on a failed job
+// SetJobMuxResult records the video the translations of a job were added
+// to, or the error that prevented adding them. It must be called before
+// SetJobResult, which marks the job partial if muxing failed.
+func (jm *JobManager) SetJobMuxResult(id string, path string, muxErr error) error {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
+		return fmt.Errorf("job not found: %s", id)
+	}
+
+	job.Result.MuxedPath = path
+	job.Result.MuxError = ""
+	if muxErr != nil {
+		job.Result.MuxError = muxErr.Error()
+	}
+	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	return nil
+}
+
+// SetJobError sets an error on a failed job, unless it was cancelled
 func (jm *JobManager) SetJobError(id string, err error) error {
 	jm.mutex.Lock()
 	defer jm.mutex.Unlock()
@@ -179,203 +692,501 @@ func (jm *JobManager) SetJobError(id string, err error) error {
 	if !exists {
 		return fmt.Errorf("job not found: %s", id)
 	}
+	if job.Status == JobStatusCancelled {
+		return nil
+	}
 
 	job.Status = JobStatusFailed
 	job.Result.Error = err.Error()
 	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+	jm.webhooks.DispatchJob(WebhookJobFailed, *job)
 	return nil
 }
 
-// ProcessJob processes a translation job asynchronously
-func (jm *JobManager) ProcessJob(id string) {
-	go func() {
-		// Get the job
-		job, err := jm.GetJob(id)
-		if err != nil {
-			slog.Error("Error getting job", "id", id, "error", err)
-			return
-		}
+// CancelJob cancels a queued or running job. Running jobs stop their
+// ffmpeg process and translation requests, keeping the outputs of the
+// languages already finished.
+func (jm *JobManager) CancelJob(id string) error {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
 
-		// Update job status to processing
-		err = jm.UpdateJobStatus(id, JobStatusProcessing)
-		if err != nil {
-			slog.Error("Error updating job status", "id", id, "error", err)
-			return
-		}
+	job, exists := jm.jobs[id]
+	if !exists {
+		return fmt.Errorf("job not found: %s", id)
+	}
+	if !job.Status.IsActive() {
+		return fmt.Errorf("%w: job is %s", ErrJobFinished, job.Status)
+	}
 
-		// Initialize progress at 0%
-		err = jm.UpdateJobProgress(id, 0.0)
-		if err != nil {
-			slog.Error("Error updating job progress", "id", id, "error", err)
-			return
+	job.Status = JobStatusCancelled
+	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+
+	if cancel, running := jm.cancels[id]; running {
+		cancel()
+	}
+	slog.Info("Job cancelled", "id", id)
+	return nil
+}
+
+// RetryJob queues a failed or partial job again. Batches translated before
+// it failed are restored from its checkpoints.
+func (jm *JobManager) RetryJob(id string) error {
+	jm.mutex.Lock()
+	job, exists := jm.jobs[id]
+	if !exists {
+		jm.mutex.Unlock()
+		return fmt.Errorf("job not found: %s", id)
+	}
+	if job.Status != JobStatusFailed && job.Status != JobStatusPartial {
+		jm.mutex.Unlock()
+		return fmt.Errorf("%w: job is %s", ErrJobNotRetryable, job.Status)
+	}
+
+	job.Status = JobStatusPending
+	job.Progress = 0.0
+	job.Result = JobResult{}
+	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+	jm.mutex.Unlock()
+
+	slog.Info("Retrying job", "id", id, "path", job.Path)
+	if err := jm.EnqueueJob(id); err != nil {
+		jm.SetJobError(id, err)
+		return err
+	}
+	return nil
+}
+
+// startJob marks a queued job as processing and registers the function
+// cancelling it. Jobs that are no longer pending, e.g. because they were
+// cancelled while queued, are not started.
+func (jm *JobManager) startJob(id string, cancel context.CancelFunc) (*Job, error) {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	if job.Status != JobStatusPending {
+		return nil, fmt.Errorf("job is %s", job.Status)
+	}
+
+	job.Status = JobStatusProcessing
+	job.Progress = 0.0
+	job.UpdatedAt = time.Now()
+	jm.persist(job)
+	jm.notify(job, JobEventStatus)
+	jm.cancels[id] = cancel
+	return job, nil
+}
+
+// finishJob forgets the cancel function of a job that is no longer running.
+// Checkpoints are kept only for jobs that can be retried.
+func (jm *JobManager) finishJob(id string) {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+	delete(jm.cancels, id)
+
+	job, exists := jm.jobs[id]
+	if !exists || jm.store == nil {
+		return
+	}
+	if job.Status == JobStatusCompleted || job.Status == JobStatusCancelled {
+		if err := jm.store.DeleteCheckpoints(id); err != nil {
+			slog.Warn("Error deleting job checkpoints", "id", id, "error", err)
 		}
+	}
+}
 
-		// Create a progress channel for communication between components
-		progressChan := make(chan float64)
+// checkpoint returns the checkpoint of a job's translation into a language,
+// or nil if jobs are not stored
+func (jm *JobManager) checkpoint(id string, langCode string) Checkpoint {
+	if jm.store == nil {
+		return nil
+	}
+	return &jobCheckpoint{store: jm.store, jobID: id, language: langCode}
+}
 
-		// Start a goroutine to handle progress updates
+// EnqueueJob queues a job to be processed by one of the workers
+func (jm *JobManager) EnqueueJob(id string) error {
+	job, err := jm.GetJob(id)
+	if err != nil {
+		return err
+	}
+	return jm.queue.Push(id, job.Priority)
+}
+
+// StartWorkers starts the given number of workers processing queued jobs
+func (jm *JobManager) StartWorkers(count int) {
+	for i := 0; i < count; i++ {
 		go func() {
-			for progress := range progressChan {
-				err := jm.UpdateJobProgress(id, progress)
-				if err != nil {
-					slog.Error("Error updating job progress", "id", id, "error", err)
-				}
+			for {
+				jm.processJob(jm.queue.Pop())
 			}
 		}()
+	}
+}
 
-		// Detect file type
-		fileType, err := DetectFileType(job.Path)
+// processJob processes a translation job, returning when it is finished
+func (jm *JobManager) processJob(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Mark the job as processing, skipping jobs cancelled while queued
+	job, err := jm.startJob(id, cancel)
+	if err != nil {
+		slog.Info("Not processing job", "id", id, "reason", err)
+		return
+	}
+	defer jm.finishJob(id)
+
+	// Create a progress channel for communication between components
+	progressChan := make(chan float64)
+
+	// Start a goroutine to handle progress updates
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		for progress := range progressChan {
+			err := jm.UpdateJobProgress(id, progress)
+			if err != nil {
+				slog.Error("Error updating job progress", "id", id, "error", err)
+			}
+		}
+	}()
+
+	// Detect file type
+	fileType, err := DetectFileType(job.Path)
+	if err != nil {
+		slog.Error("Error detecting file type", "path", job.Path, "error", err)
+		jm.SetJobError(id, fmt.Errorf("error detecting file type: %w", err))
+		close(progressChan)
+		return
+	}
+
+	// Update progress to 1%
+	progressChan <- 1.0
+
+	// Initialize variables for processing
+	var extractedPath string
+	var createdExtractedPath bool // Extracted file did not exist before the job
+	var ff *FFmpeg
+	var subtitleTracks []SubtitleTrack // Subtitle tracks of the video
+
+	// Process based on file type
+	if fileType.IsVideo() {
+		// Verify file exists and is accessible
+		if _, err := os.Stat(job.Path); os.IsNotExist(err) {
+			slog.Error("Video file does not exist", "id", id, "path", job.Path)
+			jm.SetJobError(id, fmt.Errorf("video file '%s' does not exist", job.Path))
+			close(progressChan)
+			return
+		}
+
+		ff, err = NewFFmpeg()
+		if err != nil {
+			slog.Error("Error initializing FFmpeg", "id", id, "error", err)
+			jm.SetJobError(id, fmt.Errorf("error initializing FFmpeg: %w", err))
+			close(progressChan)
+			return
+		}
+		jm.UpdateJobStatus(id, JobStatusExtracting)
+		tracks, err := ff.ListSubtitleTracks(ctx, job.Path)
 		if err != nil {
-			slog.Error("Error detecting file type", "path", job.Path, "error", err)
-			jm.SetJobError(id, fmt.Errorf("error detecting file type: %w", err))
+			slog.Error("Error listing subtitle tracks", "id", id, "path", job.Path, "error", err)
+			jm.SetJobError(id, fmt.Errorf("error listing subtitle tracks from '%s': %w", job.Path, err))
 			close(progressChan)
 			return
 		}
 
-		// Update progress to 1%
-		progressChan <- 1.0
+		if len(tracks) == 0 {
+			slog.Error("No subtitle tracks found", "id", id, "path", job.Path)
+			jm.SetJobError(id, fmt.Errorf("no subtitle tracks found in the media file"))
+			close(progressChan)
+			return
+		}
 
-		// Initialize variables for processing
-		var extractedPath string
+		subtitleTracks = tracks
 
-		// Process based on file type
-		if fileType.IsVideo() {
-			// Verify file exists and is accessible
-			if _, err := os.Stat(job.Path); os.IsNotExist(err) {
-				slog.Error("Video file does not exist", "id", id, "path", job.Path)
-				jm.SetJobError(id, fmt.Errorf("video file '%s' does not exist", job.Path))
-				close(progressChan)
-				return
-			}
+		if job.TrackIndex < 0 || job.TrackIndex >= len(tracks) {
+			slog.Error("Invalid track index", "id", id, "index", job.TrackIndex, "total_tracks", len(tracks))
+			jm.SetJobError(id, fmt.Errorf("invalid track index %d (file has %d tracks)", job.TrackIndex, len(tracks)))
+			close(progressChan)
+			return
+		}
 
-			ff, err := NewFFmpeg()
-			if err != nil {
-				slog.Error("Error initializing FFmpeg", "id", id, "error", err)
-				jm.SetJobError(id, fmt.Errorf("error initializing FFmpeg: %w", err))
-				close(progressChan)
-				return
-			}
-			jm.UpdateJobStatus(id, JobStatusExtracting)
-			tracks, err := ff.ListSubtitleTracks(job.Path)
-			if err != nil {
-				slog.Error("Error listing subtitle tracks", "id", id, "path", job.Path, "error", err)
-				jm.SetJobError(id, fmt.Errorf("error listing subtitle tracks from '%s': %w", job.Path, err))
-				close(progressChan)
-				return
-			}
+		// Extract the subtitle track in its native format, so that ASS
+		// styling is kept
+		track := tracks[job.TrackIndex]
+		if !track.Text {
+			err := &BitmapSubtitleError{Path: job.Path, TrackIndex: job.TrackIndex, Codec: track.Format}
+			slog.Error("Subtitle track is image-based", "id", id, "index", job.TrackIndex, "codec", track.Format)
+			jm.SetJobError(id, err)
+			close(progressChan)
+			return
+		}
 
-			if len(tracks) == 0 {
-				slog.Error("No subtitle tracks found", "id", id, "path", job.Path)
-				jm.SetJobError(id, fmt.Errorf("no subtitle tracks found in the media file"))
-				close(progressChan)
-				return
-			}
+		// Update progress to 2%
+		progressChan <- 2.0
+		outputFormat := nativeSubtitleFormat(track.Format)
+		langCode := "en"
+		// Use language from track if available
+		if track.Language != "" {
+			langCode = track.Language
+		}
 
-			if job.TrackIndex < 0 || job.TrackIndex >= len(tracks) {
-				slog.Error("Invalid track index", "id", id, "index", job.TrackIndex, "total_tracks", len(tracks))
-				jm.SetJobError(id, fmt.Errorf("invalid track index %d (file has %d tracks)", job.TrackIndex, len(tracks)))
-				close(progressChan)
-				return
-			}
+		slog.Info("Extracting subtitle track", "id", id, "track_index", job.TrackIndex,
+			"format", outputFormat, "path", job.Path)
 
-			// Update progress to 2%
-			progressChan <- 2.0
+		_, err = os.Stat(extractedSubtitlePath(job.Path, outputFormat, langCode))
+		createdExtractedPath = os.IsNotExist(err)
 
-			// Extract the subtitle track
-			outputFormat := "srt"
-			langCode := "en"
-			// Use language from track if available
-			if track := tracks[job.TrackIndex]; track.Language != "" {
-				langCode = track.Language
+		extractedPath, err = ff.ExtractSubtitleTrack(ctx, job.Path, job.TrackIndex, outputFormat, langCode)
+		if ctx.Err() != nil {
+			if createdExtractedPath {
+				removePartialFile(extractedSubtitlePath(job.Path, outputFormat, langCode))
 			}
+			close(progressChan)
+			slog.Info("Job cancelled during extraction", "id", id)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to extract subtitle", "id", id, "error", err)
+			jm.SetJobError(id, fmt.Errorf("error extracting subtitle track %d from '%s': %w",
+				job.TrackIndex, job.Path, err))
+			close(progressChan)
+			return
+		}
 
-			slog.Info("Extracting subtitle track", "id", id, "track_index", job.TrackIndex,
-				"format", outputFormat, "path", job.Path)
+		// Verify extracted file exists and is readable
+		if _, err := os.Stat(extractedPath); os.IsNotExist(err) {
+			slog.Error("Extracted subtitle file does not exist", "id", id, "path", extractedPath)
+			jm.SetJobError(id, fmt.Errorf("extracted subtitle file '%s' does not exist", extractedPath))
+			close(progressChan)
+			return
+		}
 
-			extractedPath, err = ff.ExtractSubtitleTrack(job.Path, job.TrackIndex, outputFormat, langCode)
-			if err != nil {
-				slog.Error("Failed to extract subtitle", "id", id, "error", err)
-				jm.SetJobError(id, fmt.Errorf("error extracting subtitle track %d from '%s': %w",
-					job.TrackIndex, job.Path, err))
-				close(progressChan)
-				return
-			}
+		// Update progress to 20%
+		progressChan <- 20.0
+	} else if fileType.IsSubtitle() {
+		// Verify subtitle file exists and is accessible
+		if _, err := os.Stat(job.Path); os.IsNotExist(err) {
+			slog.Error("Subtitle file does not exist", "id", id, "path", job.Path)
+			jm.SetJobError(id, fmt.Errorf("subtitle file '%s' does not exist", job.Path))
+			close(progressChan)
+			return
+		}
 
-			// Verify extracted file exists and is readable
-			if _, err := os.Stat(extractedPath); os.IsNotExist(err) {
-				slog.Error("Extracted subtitle file does not exist", "id", id, "path", extractedPath)
-				jm.SetJobError(id, fmt.Errorf("extracted subtitle file '%s' does not exist", extractedPath))
-				close(progressChan)
-				return
-			}
+		extractedPath = job.Path
+		slog.Info("Using subtitle file directly", "id", id, "path", extractedPath)
 
-			// Update progress to 20%
-			progressChan <- 20.0
-		} else if fileType.IsSubtitle() {
-			// Verify subtitle file exists and is accessible
-			if _, err := os.Stat(job.Path); os.IsNotExist(err) {
-				slog.Error("Subtitle file does not exist", "id", id, "path", job.Path)
-				jm.SetJobError(id, fmt.Errorf("subtitle file '%s' does not exist", job.Path))
-				close(progressChan)
-				return
-			}
+		// Update progress to 30% (skip extraction steps)
+		progressChan <- 20.0
+	} else {
+		slog.Error("Unsupported file type", "id", id, "file_type", fileType)
+		jm.SetJobError(id, fmt.Errorf("unsupported file type: %s", fileType))
+		close(progressChan)
+		return
+	}
+	jm.UpdateJobStatus(id, JobStatusTranslating)
 
-			extractedPath = job.Path
-			slog.Info("Using subtitle file directly", "id", id, "path", extractedPath)
+	// Load the glossary of the show or media path
+	glossary, err := LoadGlossaryForFile(job.Path)
+	if err != nil {
+		slog.Error("Error loading glossary", "id", id, "path", job.Path, "error", err)
+		jm.SetJobError(id, fmt.Errorf("error loading glossary: %w", err))
+		close(progressChan)
+		return
+	}
 
-			// Update progress to 30% (skip extraction steps)
-			progressChan <- 20.0
-		} else {
-			slog.Error("Unsupported file type", "id", id, "file_type", fileType)
-			jm.SetJobError(id, fmt.Errorf("unsupported file type: %s", fileType))
-			close(progressChan)
-			return
+	// Translate the extracted subtitle into each target language, giving
+	// every language an equal share of the progress between 20% and 95%
+	var outputs []JobOutput
+	languageShare := 75.0 / float64(len(job.TargetLanguages))
+	for i, langCode := range job.TargetLanguages {
+		if ctx.Err() != nil {
+			break
 		}
-		jm.UpdateJobStatus(id, JobStatusTranslating)
-		// Translate the extracted subtitle
-		outputPath := deriveOutputPath(extractedPath)
-		translator := NewTranslator()
+		progressStart := 20.0 + float64(i)*languageShare
 
 		// Create a goroutine to handle translation progress scaling
 		translationProgressChan := make(chan float64)
+		progressDone := make(chan struct{})
 		go func() {
+			defer close(progressDone)
 			for progress := range translationProgressChan {
-				scaledProgress := 20.0 + (progress * 0.75)
-				progressChan <- scaledProgress
+				progressChan <- progressStart + progress*languageShare/100.0
 			}
 		}()
 
-		// Set the translation progress channel
-		translator.SetProgressChannel(translationProgressChan)
-
-		err = translator.TranslateSubtitleFile(extractedPath, outputPath)
-		if err != nil {
-			jm.SetJobError(id, fmt.Errorf("error translating subtitles: %w", err))
-			close(translationProgressChan)
-			close(progressChan)
-			return
+		slog.Info("Translating subtitles", "id", id, "language", langCode, "path", extractedPath)
+		output := translateToLanguage(ctx, extractedPath, langCode, job.Backend, glossary,
+			jm.checkpoint(id, langCode), translationProgressChan)
+		if ctx.Err() == nil {
+			outputs = append(outputs, output)
 		}
 
 		// Close the translation progress channel as it's no longer needed
 		close(translationProgressChan)
+		<-progressDone
+	}
 
-		// Update progress to 95%
-		progressChan <- 99.0
+	// Add the translations to the video as new tracks if configured
+	output := GetOutputConfig(job.Path)
+	muxing := output.Mode == OutputModeMuxCopy || output.Mode == OutputModeMuxReplace
+	if fileType.IsVideo() && muxing && ctx.Err() == nil {
+		slog.Info("Adding translations to video", "id", id, "path", job.Path, "mode", output.Mode)
+		muxedPath, err := muxOutputs(ctx, ff, job.Path, subtitleTracks, outputs, output)
+		if err == nil {
+			jm.SetJobMuxResult(id, muxedPath, nil)
+		} else if ctx.Err() == nil {
+			// Keep the subtitle files, the job becomes partial
+			slog.Error("Error adding translations to video", "id", id, "error", err)
+			jm.SetJobMuxResult(id, "", fmt.Errorf("error adding translations to '%s': %w", job.Path, err))
+		}
+	}
 
-		// Set the job result
-		err = jm.SetJobResult(id, outputPath)
-		if err != nil {
-			slog.Error("Error setting job result", "id", id, "error", err)
-			close(progressChan)
-			return
+	if ctx.Err() != nil {
+		// Keep the languages finished before the job was cancelled, but not
+		// a track extracted only for this job
+		if createdExtractedPath {
+			removePartialFile(extractedPath)
 		}
+		jm.SetJobResult(id, outputs)
+		close(progressChan)
+		slog.Info("Job cancelled", "id", id, "outputs", len(outputs))
+		return
+	}
 
-		// Update progress to 100%
-		progressChan <- 100.0
+	// Update progress to 100% and wait until it is applied, so that
+	// subscribers see it before the job finishes
+	progressChan <- 100.0
+	close(progressChan)
+	<-progressDone
 
-		// Close the progress channel as we're done
-		close(progressChan)
+	// Set the job result
+	err = jm.SetJobResult(id, outputs)
+	if err != nil {
+		slog.Error("Error setting job result", "id", id, "error", err)
+		return
+	}
 
-		slog.Info("Job completed successfully", "id", id)
-	}()
+	slog.Info("Job finished", "id", id, "outputs", len(outputs))
+}
+
+// translateToLanguage translates a subtitle file into a single language,
+// writing the output next to the input file
+func translateToLanguage(ctx context.Context, inputPath string, langCode string, backend string,
+	glossary *Glossary, checkpoint Checkpoint, progressChan chan<- float64) JobOutput {
+	output := JobOutput{
+		Language:   langCode,
+		OutputPath: deriveOutputPath(inputPath, langCode),
+	}
+
+	config := GetTranslationConfigForFile(inputPath, backend)
+	config.TargetLanguage = languageFullName(langCode)
+	if config.TargetLanguage == "" {
+		config.TargetLanguage = langCode
+	}
+
+	translator, err := NewTranslatorWithConfig(config)
+	if err != nil {
+		slog.Error("Error creating translator", "language", langCode, "error", err)
+		output.OutputPath = ""
+		output.Error = err.Error()
+		return output
+	}
+	translator.SetProgressChannel(progressChan)
+	translator.SetRequestLimiter(GetRequestLimiter())
+	translator.SetCheckpoint(checkpoint)
+	translator.SetGlossary(glossary.Entries(langCode))
+	if config.Memory {
+		// Extracted tracks are named after the language of the track
+		sourceLanguage, _ := determineLanguageAndTypeFromFilename(inputPath)
+		translator.SetSourceLanguage(sourceLanguage)
+		translator.SetMemory(GetDB())
+	}
+
+	err = translator.TranslateSubtitleFile(ctx, inputPath, output.OutputPath)
+	output.GlossaryViolations = translator.GlossaryViolations()
+	output.MemoryHits, output.MemoryMisses = translator.MemoryStats()
+	if err == nil {
+		return output
+	}
+
+	output.Error = err.Error()
+	var partialErr *PartialTranslationError
+	if errors.As(err, &partialErr) {
+		output.UntranslatedIndices = partialErr.UntranslatedIndices
+	}
+	if partialErr == nil || !config.AllowPartial {
+		// Nothing was written
+		output.OutputPath = ""
+	}
+	slog.Warn("Translation did not complete", "language", langCode, "error", err)
+	return output
+}
+
+// muxOutputs adds the translated subtitles to a video as new tracks, in a
+// copy of the video or in the video itself as configured. The video is
+// written to a temporary file first, so that a failed or cancelled run never
+// leaves a truncated video behind. It returns the path of the video with the
+// tracks, or an empty path if no translation was written.
+func muxOutputs(ctx context.Context, ff *FFmpeg, videoPath string, subtitleTracks []SubtitleTrack,
+	outputs []JobOutput, config OutputConfig) (string, error) {
+	title := config.TrackTitle
+	if title == "" {
+		title = DefaultTrackTitle
+	}
+
+	var subtitles []MuxedSubtitle
+	for _, output := range outputs {
+		if output.OutputPath == "" {
+			continue
+		}
+		name := languageFullName(output.Language)
+		if name == "" {
+			name = output.Language
+		}
+		subtitles = append(subtitles, MuxedSubtitle{
+			Path:     output.OutputPath,
+			Language: languageAlpha3(output.Language),
+			Title:    strings.ReplaceAll(title, "{language}", name),
+			Default:  config.defaultTrack() && len(subtitles) == 0,
+		})
+	}
+	if len(subtitles) == 0 {
+		return "", nil
+	}
+
+	muxedPath := muxedOutputPath(videoPath, config)
+	if err := os.MkdirAll(filepath.Dir(muxedPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	ext := filepath.Ext(muxedPath)
+	tempPath := filepath.Join(filepath.Dir(muxedPath),
+		"."+strings.TrimSuffix(filepath.Base(muxedPath), ext)+".muxing"+ext)
+
+	if err := ff.MuxSubtitles(ctx, videoPath, tempPath, subtitleTracks, subtitles); err != nil {
+		removePartialFile(tempPath)
+		return "", err
+	}
+	if err := os.Rename(tempPath, muxedPath); err != nil {
+		removePartialFile(tempPath)
+		return "", fmt.Errorf("failed to move muxed video to '%s': %w", muxedPath, err)
+	}
+	return muxedPath, nil
+}
+
+// removePartialFile deletes a file left behind by a cancelled job
+func removePartialFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Error removing partial file", "path", path, "error", err)
+	}
 }
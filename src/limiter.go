@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestLimiter bounds the number of concurrent requests to translation
+// backends across all translators. A nil limiter does not limit anything.
+type RequestLimiter struct {
+	slots chan struct{}
+}
+
+var requestLimiter *RequestLimiter
+var requestLimiterOnce sync.Once
+
+// GetRequestLimiter returns the limiter shared by all jobs, sized by the
+// translation.global_concurrency setting
+func GetRequestLimiter() *RequestLimiter {
+	requestLimiterOnce.Do(func() {
+		requestLimiter = NewRequestLimiter(GetTranslationConfig().GlobalConcurrency)
+	})
+	return requestLimiter
+}
+
+// NewRequestLimiter creates a limiter allowing the given number of
+// concurrent requests
+func NewRequestLimiter(limit int) *RequestLimiter {
+	return &RequestLimiter{slots: make(chan struct{}, limit)}
+}
+
+// Acquire waits for a free request slot or until the context is done
+func (l *RequestLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a request slot taken by Acquire
+func (l *RequestLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"time"
@@ -23,6 +24,7 @@ func main() {
 	slog.Info("Starting application")
 
 	InitDatabase()
+	GetJobManager().ResumeInterruptedJobs()
 	stopChannel := RunBackgroundSync()
 	RunWebService()
 	stopChannel <- true
@@ -40,7 +42,8 @@ func RunBackgroundSync() chan (bool) {
 			case <-ticker.C:
 				slog.Info("Running background sync")
 				startTime := time.Now()
-				for _, path := range mediaPaths {
+				for name, path := range mediaPaths {
+					pathStartTime := time.Now()
 					slog.Info("Syncing media path", "path", path)
 					current, err := db.GetCachedMediaFiles(path.Path)
 					if err != nil {
@@ -48,7 +51,7 @@ func RunBackgroundSync() chan (bool) {
 						slog.Warn("Failed to get cached media files", "path", path.Path, "error", err)
 						continue
 					}
-					mediaFiles, err := FindMediaFiles(path.Path, current)
+					mediaFiles, err := FindMediaFiles(context.Background(), path.Path, current)
 					if err != nil {
 						// Log the error but continue
 						slog.Warn("Failed to find media files", "path", path.Path, "error", err)
@@ -60,6 +63,15 @@ func RunBackgroundSync() chan (bool) {
 							slog.Warn("Failed to cache media files", "error", err)
 						}
 					}
+					GetWebhookDispatcher().Dispatch(WebhookPayload{
+						Event: WebhookScanCompleted,
+						Scan: &ScanSummary{
+							MediaPath: name,
+							Path:      path.Path,
+							Files:     len(mediaFiles),
+							Duration:  time.Since(pathStartTime).Seconds(),
+						},
+					})
 				}
 				endTime := time.Now()
 				slog.Info("Background sync completed", "duration", endTime.Sub(startTime))
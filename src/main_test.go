@@ -1,7 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/asticode/go-astisub"
 )
 
 func TestDeriveOutputPath(t *testing.T) {
@@ -94,10 +107,1182 @@ func TestDeriveOutputPath(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			actual := deriveOutputPath(tc.input)
+			actual := deriveOutputPath(tc.input, "pl")
 			if actual != tc.expected {
-				t.Errorf("deriveOutputPath(%q) = %q, want %q", tc.input, actual, tc.expected)
+				t.Errorf("deriveOutputPath(%q, \"pl\") = %q, want %q", tc.input, actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRenderOutputPath(t *testing.T) {
+	jellyfin := OutputConfig{Template: "{base}.{lang}{.forced}{.sdh}{.ext}"}
+
+	testCases := []struct {
+		name     string
+		input    string
+		langCode string
+		output   OutputConfig
+		expected string
+	}{
+		{
+			name:     "three letter french code",
+			input:    "/media/movie.fre.srt",
+			langCode: "de",
+			expected: "/media/movie.de.srt",
+		},
+		{
+			name:     "spanish sdh with default template drops the type",
+			input:    "/media/movie.spa.sdh.srt",
+			langCode: "cs",
+			expected: "/media/movie.cs.srt",
+		},
+		{
+			name:     "spanish sdh with jellyfin template keeps the type",
+			input:    "/media/movie.spa.sdh.srt",
+			langCode: "pl",
+			output:   jellyfin,
+			expected: "/media/movie.pl.sdh.srt",
+		},
+		{
+			name:     "forced english with jellyfin template",
+			input:    "/media/movie_en.forced.ass",
+			langCode: "pl",
+			output:   jellyfin,
+			expected: "/media/movie.pl.forced.ass",
+		},
+		{
+			name:     "title word is not mistaken for a language",
+			input:    "/media/What.It.Is.srt",
+			langCode: "pl",
+			expected: "/media/What.It.Is.pl.srt",
+		},
+		{
+			name:     "hindi-like type segment without language is kept",
+			input:    "/media/movie.hi.srt",
+			langCode: "pl",
+			expected: "/media/movie.hi.pl.srt",
+		},
+		{
+			name:     "relative output directory",
+			input:    "/media/show/episode.eng.srt",
+			langCode: "pl",
+			output:   OutputConfig{Directory: "translated"},
+			expected: "/media/show/translated/episode.pl.srt",
+		},
+		{
+			name:     "absolute output directory with template",
+			input:    "/media/show/episode.eng.hi.srt",
+			langCode: "de",
+			output:   OutputConfig{Template: "{base}.{lang}{.hi}.{ext}", Directory: "/subs"},
+			expected: "/subs/episode.de.hi.srt",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := renderOutputPath(tc.input, tc.langCode, tc.output)
+			if actual != tc.expected {
+				t.Errorf("renderOutputPath(%q, %q) = %q, want %q", tc.input, tc.langCode, actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "network error", err: errors.New("connection reset"), retryable: true},
+		{name: "rate limited", err: &BackendError{StatusCode: 429, Err: errors.New("slow down")}, retryable: true},
+		{name: "server error", err: &BackendError{StatusCode: 503, Err: errors.New("unavailable")}, retryable: true},
+		{name: "bad request", err: &BackendError{StatusCode: 400, Err: errors.New("bad request")}, retryable: false},
+		{name: "unauthorized", err: fmt.Errorf("wrapped: %w", &BackendError{StatusCode: 401, Err: errors.New("no key")}), retryable: false},
+		{name: "cancelled", err: context.Canceled, retryable: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := isRetryableError(tc.err); actual != tc.retryable {
+				t.Errorf("isRetryableError(%v) = %v, want %v", tc.err, actual, tc.retryable)
 			}
 		})
 	}
-}
\ No newline at end of file
+
+	retryAfter := &BackendError{StatusCode: 429, RetryAfter: 7 * time.Second, Err: errors.New("slow down")}
+	if delay := retryDelay(0, time.Second, time.Minute, retryAfter); delay != 7*time.Second {
+		t.Errorf("retryDelay with Retry-After = %s, want 7s", delay)
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := retryDelay(attempt, time.Second, 10*time.Second, errors.New("timeout"))
+		if delay < 500*time.Millisecond || delay > 10*time.Second {
+			t.Errorf("retryDelay(%d) = %s, want between 500ms and 10s", attempt, delay)
+		}
+	}
+}
+
+func TestValidateTranslations(t *testing.T) {
+	subtitle := func(index int, texts ...string) Subtitle {
+		var lines []Line
+		for _, text := range texts {
+			lines = append(lines, Line{Items: []LineItem{{Text: text}}})
+		}
+		return Subtitle{Index: index, Lines: lines}
+	}
+
+	source := []Subtitle{
+		subtitle(1, "Hello"),
+		subtitle(2, "How are you?", "Fine"),
+		subtitle(3, "Goodbye"),
+		subtitle(4, "See you"),
+		subtitle(5, "Later"),
+	}
+	translated := []Subtitle{
+		subtitle(1, "Cześć"),
+		subtitle(2, "Jak się masz? Dobrze"), // lines merged
+		subtitle(4, "Do zobaczenia"),
+		subtitle(4, "Na razie"), // duplicated index
+		subtitle(5, ""),         // emptied text
+		subtitle(9, "Extra"),    // not in the batch
+	}
+
+	valid, broken, issues := validateTranslations(source, translated)
+
+	if len(valid) != 1 || valid[0].Index != 1 {
+		t.Errorf("valid = %v, want only subtitle 1", valid)
+	}
+
+	var brokenIndices []int
+	for _, sub := range broken {
+		brokenIndices = append(brokenIndices, sub.Index)
+	}
+	if fmt.Sprint(brokenIndices) != "[2 3 4 5]" {
+		t.Errorf("broken = %v, want [2 3 4 5]", brokenIndices)
+	}
+
+	if len(issues) != 5 {
+		t.Errorf("got %d issues, want 5: %v", len(issues), issues)
+	}
+}
+
+func TestCheckGlossary(t *testing.T) {
+	glossary := &Glossary{
+		Terms: []GlossaryTerm{
+			{Source: "Stormlight", Translations: map[string]string{"pl": "Burzowe Światło"}, Target: "Stormlight"},
+			{Source: "highprince", Target: "arcyksiążę"},
+		},
+		Names: []string{"Kaladin"},
+	}
+	entries := glossary.Entries("pl")
+
+	source := []Subtitle{
+		{Index: 1, Lines: []Line{{Items: []LineItem{{Text: "Kaladin drew in Stormlight."}}}}},
+		{Index: 2, Lines: []Line{{Items: []LineItem{{Text: "Ask the Highprince."}}}}},
+		{Index: 3, Lines: []Line{{Items: []LineItem{{Text: "Highprinces are proud."}}}}},
+	}
+	translated := []Subtitle{
+		{Index: 1, Lines: []Line{{Items: []LineItem{{Text: "Kaladin wciągnął Burzowe Światło."}}}}},
+		{Index: 2, Lines: []Line{{Items: []LineItem{{Text: "Zapytaj księcia."}}}}},
+		{Index: 3, Lines: []Line{{Items: []LineItem{{Text: "Książęta są dumni."}}}}},
+	}
+
+	if relevant := relevantGlossaryEntries(entries, source[:1]); len(relevant) != 2 {
+		t.Errorf("relevantGlossaryEntries = %v, want Stormlight and Kaladin", relevant)
+	}
+
+	// Subtitle 3 only contains a longer word starting with the term
+	violations := checkGlossary(entries, source, translated)
+	if len(violations) != 1 || violations[0].Index != 2 || violations[0].Expected != "arcyksiążę" {
+		t.Errorf("checkGlossary = %v, want a single violation for subtitle 2", violations)
+	}
+
+	// Inflected forms of the expected translation are accepted
+	if !containsTerm("Widziałem Kaladina.", "Kaladin", false) {
+		t.Errorf("containsTerm did not accept an inflected name")
+	}
+}
+
+// countingBackend returns its input unchanged, counting translated subtitles
+type countingBackend struct {
+	translated atomic.Int64
+}
+
+func (b *countingBackend) Name() string { return "test" }
+
+func (b *countingBackend) TranslateBatch(ctx context.Context, request BatchRequest) ([]Subtitle, error) {
+	b.translated.Add(int64(len(request.Subtitles)))
+	return request.Subtitles, nil
+}
+
+// mapMemory is a translation memory kept in a map
+type mapMemory map[TranslationMemoryKey]map[string][]Line
+
+func (m mapMemory) LookupTranslations(key TranslationMemoryKey, sourceTexts []string) (map[string][]Line, error) {
+	found := make(map[string][]Line)
+	for _, text := range sourceTexts {
+		if lines, ok := m[key][text]; ok {
+			found[text] = lines
+		}
+	}
+	return found, nil
+}
+
+func (m mapMemory) StoreTranslations(key TranslationMemoryKey, translations map[string][]Line) error {
+	if m[key] == nil {
+		m[key] = make(map[string][]Line)
+	}
+	for text, lines := range translations {
+		m[key][text] = lines
+	}
+	return nil
+}
+
+func TestTranslationMemory(t *testing.T) {
+	items := func(texts ...string) []*astisub.Item {
+		var items []*astisub.Item
+		for i, text := range texts {
+			items = append(items, &astisub.Item{
+				Index: i + 1,
+				Lines: []astisub.Line{{Items: []astisub.LineItem{{Text: text}}}},
+			})
+		}
+		return items
+	}
+
+	backend := &countingBackend{}
+	memory := mapMemory{}
+	config := DefaultTranslationConfig()
+
+	first := NewTranslatorWithBackend(backend, config)
+	first.SetMemory(memory)
+	first.SetSourceLanguage("en")
+	if _, err := first.translateBatch(context.Background(), items("Hello", "How are you?"), BatchRequest{}); err != nil {
+		t.Fatalf("translateBatch failed: %v", err)
+	}
+
+	// A different release with changed spacing only needs the new subtitle
+	second := NewTranslatorWithBackend(backend, config)
+	second.SetMemory(memory)
+	second.SetSourceLanguage("en")
+	translated, err := second.translateBatch(context.Background(), items("Hello", "How  are you? ", "Goodbye"), BatchRequest{})
+	if err != nil {
+		t.Fatalf("translateBatch failed: %v", err)
+	}
+	if len(translated) != 3 {
+		t.Errorf("got %d translations, want 3", len(translated))
+	}
+	if hits, misses := second.MemoryStats(); hits != 2 || misses != 1 {
+		t.Errorf("MemoryStats = %d hits, %d misses, want 2 and 1", hits, misses)
+	}
+	if translated := backend.translated.Load(); translated != 3 {
+		t.Errorf("backend translated %d subtitles, want 3", translated)
+	}
+
+	// Translations from another source language are not reused
+	other := NewTranslatorWithBackend(backend, config)
+	other.SetMemory(memory)
+	other.SetSourceLanguage("fr")
+	other.translateBatch(context.Background(), items("Hello"), BatchRequest{})
+	if hits, _ := other.MemoryStats(); hits != 0 {
+		t.Errorf("MemoryStats = %d hits for another source language, want 0", hits)
+	}
+
+	// Subtitles with glossary terms are always translated with the glossary
+	withGlossary := NewTranslatorWithBackend(backend, config)
+	withGlossary.SetMemory(memory)
+	withGlossary.SetSourceLanguage("en")
+	withGlossary.SetGlossary([]GlossaryEntry{{Source: "Goodbye", Target: "Do widzenia"}, {Source: "Farewell", Target: "Żegnaj"}})
+	before := backend.translated.Load()
+	withGlossary.translateBatch(context.Background(), items("Hello", "Goodbye", "Farewell"), BatchRequest{})
+	if hits, misses := withGlossary.MemoryStats(); hits != 1 || misses != 0 {
+		t.Errorf("MemoryStats = %d hits, %d misses with a glossary, want 1 and 0", hits, misses)
+	}
+	if translated := backend.translated.Load() - before; translated != 2 {
+		t.Errorf("backend translated %d subtitles with a glossary, want 2", translated)
+	}
+	if _, stored := memory[withGlossary.memoryKey()]["Farewell"]; stored {
+		t.Errorf("translation made with a glossary was stored in memory")
+	}
+
+	// Translations made with context are only reused in the same context
+	translateFile := func(texts ...string) *Translator {
+		translator := NewTranslatorWithBackend(backend, config)
+		translator.SetMemory(memory)
+		translator.SetSourceLanguage("en")
+		if err := translator.TranslateSubtitles(context.Background(), &astisub.Subtitles{Items: items(texts...)}); err != nil {
+			t.Fatalf("TranslateSubtitles failed: %v", err)
+		}
+		return translator
+	}
+	translateFile("Run!", "He is here.", "Hide!")
+	if hits, _ := translateFile("Stop!", "He is here.", "Wait.").MemoryStats(); hits != 0 {
+		t.Errorf("MemoryStats = %d hits in another context, want 0", hits)
+	}
+	if hits, _ := translateFile("Run!", "He is here.", "Hide!").MemoryStats(); hits != 3 {
+		t.Errorf("MemoryStats = %d hits in the same context, want 3", hits)
+	}
+}
+
+func TestProtectMarkup(t *testing.T) {
+	italic := &astisub.StyleAttributes{SRTItalics: true}
+	item := &astisub.Item{
+		Index: 1,
+		Lines: []astisub.Line{
+			{Items: []astisub.LineItem{{Text: `{\an8}Where is <b>he</b>?`}}},
+			{Items: []astisub.LineItem{{Text: "He said "}, {Text: "hello", InlineStyle: italic}}},
+		},
+	}
+
+	protected, _ := protectItem(item)
+	if text := protected.Lines[0].Items[0].Text; text != "⟦1⟧Where is ⟦2⟧he⟦3⟧?" {
+		t.Errorf("protected line 1 = %q", text)
+	}
+	if text := protected.Lines[1].Items[0].Text; text != "⟦4⟧He said ⟦5⟧⟦6⟧hello⟦7⟧" {
+		t.Errorf("protected line 2 = %q", text)
+	}
+
+	// Dropping a placeholder fails validation
+	broken := Subtitle{Index: 1, Lines: []Line{
+		{Items: []LineItem{{Text: "⟦1⟧Gdzie ⟦2⟧on⟦3⟧ jest?"}}},
+		{Items: []LineItem{{Text: "⟦6⟧Cześć⟦7⟧, powiedział"}}},
+	}}
+	if problem := compareStructure(protected, broken); problem == "" {
+		t.Errorf("compareStructure accepted a translation with missing placeholders")
+	}
+
+	// Items may be reordered by the translation
+	translation := Subtitle{Index: 1, Lines: []Line{
+		{Items: []LineItem{{Text: "⟦1⟧Gdzie ⟦2⟧on⟦3⟧ jest?"}}},
+		{Items: []LineItem{{Text: "⟦6⟧Cześć⟦7⟧, ⟦4⟧powiedział⟦5⟧"}}},
+	}}
+	if problem := compareStructure(protected, translation); problem != "" {
+		t.Fatalf("compareStructure = %q, want no problem", problem)
+	}
+	restoreItem(item, translation)
+
+	if text := item.Lines[0].Items[0].Text; text != `{\an8}Gdzie <b>on</b> jest?` {
+		t.Errorf("restored line 1 = %q", text)
+	}
+	restored := item.Lines[1].Items
+	if len(restored) != 3 || restored[0].Text != "Cześć" || restored[0].InlineStyle != italic ||
+		restored[1].Text != ", " || restored[2].Text != "powiedział" || restored[2].InlineStyle != nil {
+		t.Errorf("restored line 2 = %+v", restored)
+	}
+}
+
+func TestDialogueItems(t *testing.T) {
+	item := func(index int, effect, text string) *astisub.Item {
+		return &astisub.Item{Index: index, Lines: []astisub.Line{{Items: []astisub.LineItem{
+			{InlineStyle: &astisub.StyleAttributes{SSAEffect: effect}, Text: text},
+		}}}}
+	}
+
+	items := []*astisub.Item{
+		item(0, `{\an8}`, "Sign text"),
+		item(0, `{\p1}`, "m 0 0 l 100 0 100 100 0 100"),
+		item(0, `{\k20}`, "Ka"),
+		item(0, "", "Dialogue"),
+	}
+	ensureUniqueIndices(items)
+	for i, item := range items {
+		if item.Index != i+1 {
+			t.Errorf("item %d has index %d, want %d", i, item.Index, i+1)
+		}
+	}
+
+	dialogue := dialogueItems(items)
+	if len(dialogue) != 2 || dialogue[0].Index != 1 || dialogue[1].Index != 4 {
+		t.Errorf("dialogueItems returned %d items, want items 1 and 4", len(dialogue))
+	}
+
+	if format := nativeSubtitleFormat("ssa"); format != "ass" {
+		t.Errorf("nativeSubtitleFormat(ssa) = %q, want ass", format)
+	}
+	if format := nativeSubtitleFormat("subrip"); format != "srt" {
+		t.Errorf("nativeSubtitleFormat(subrip) = %q, want srt", format)
+	}
+}
+
+// mapJobStore is a job store kept in a map
+type mapJobStore map[string]Job
+
+func (s mapJobStore) SaveJob(job Job) error {
+	s[job.ID] = job
+	return nil
+}
+
+func (s mapJobStore) LoadJobs() ([]*Job, error) {
+	var jobs []*Job
+	for _, job := range s {
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+func (s mapJobStore) LoadCheckpoint(jobID, language string) ([]Subtitle, error) {
+	return nil, nil
+}
+
+func (s mapJobStore) SaveCheckpoint(jobID, language string, translations []Subtitle) error {
+	return nil
+}
+
+func (s mapJobStore) DeleteCheckpoints(jobID string) error {
+	return nil
+}
+
+func TestJobPersistence(t *testing.T) {
+	store := mapJobStore{}
+	jm := NewJobManagerWithStore(store, true)
+	running, _ := jm.CreateJob(JobRequest{Path: "/media/a.srt", TargetLanguages: []string{"pl"}})
+	jm.UpdateJobStatus(running.ID, JobStatusTranslating)
+	done, _ := jm.CreateJob(JobRequest{Path: "/media/b.srt", TargetLanguages: []string{"pl"}})
+	jm.SetJobResult(done.ID, []JobOutput{{Language: "pl", OutputPath: "/media/b.pl.srt"}})
+
+	if store[running.ID].Status != JobStatusTranslating {
+		t.Errorf("stored status = %q, want %q", store[running.ID].Status, JobStatusTranslating)
+	}
+
+	// After a restart the running job is pending again
+	resumed := NewJobManagerWithStore(store, true)
+	if job, err := resumed.GetJob(running.ID); err != nil || job.Status != JobStatusPending {
+		t.Errorf("interrupted job = %+v, %v, want pending", job, err)
+	}
+	if job, err := resumed.GetJob(done.ID); err != nil || job.Result.OutputPath != "/media/b.pl.srt" {
+		t.Errorf("completed job = %+v, %v, want its result kept", job, err)
+	}
+	if len(resumed.interrupted) != 1 {
+		t.Errorf("got %d interrupted jobs, want 1", len(resumed.interrupted))
+	}
+
+	// Or failed if resuming is disabled
+	store[running.ID] = Job{ID: running.ID, Status: JobStatusProcessing}
+	failed := NewJobManagerWithStore(store, false)
+	if job, _ := failed.GetJob(running.ID); job.Status != JobStatusFailed {
+		t.Errorf("interrupted job status = %q, want %q", job.Status, JobStatusFailed)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	queue := NewJobQueue(4)
+	queue.Push("first", 0)
+	queue.Push("second", 0)
+	queue.Push("urgent", 10)
+	queue.Push("third", 0)
+	if err := queue.Push("overflow", 0); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Push to a full queue returned %v, want ErrQueueFull", err)
+	}
+
+	var order []string
+	for queue.Len() > 0 {
+		order = append(order, queue.Pop())
+	}
+	if fmt.Sprint(order) != "[urgent first second third]" {
+		t.Errorf("jobs popped in order %v, want [urgent first second third]", order)
+	}
+
+	limiter := NewRequestLimiter(1)
+	limiter.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx); err == nil {
+		t.Errorf("Acquire succeeded with no free slot")
+	}
+	limiter.Release()
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Errorf("Acquire after Release failed: %v", err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	jm := NewJobManagerWithStore(nil, false)
+	queued, _ := jm.CreateJob(JobRequest{Path: "/media/a.srt", TargetLanguages: []string{"pl"}})
+
+	if err := jm.CancelJob(queued.ID); err != nil {
+		t.Fatalf("CancelJob failed: %v", err)
+	}
+	if err := jm.CancelJob(queued.ID); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("cancelling a cancelled job returned %v, want ErrJobFinished", err)
+	}
+
+	// A job cancelled while queued is not started, and keeps its status
+	if _, err := jm.startJob(queued.ID, func() {}); err == nil {
+		t.Errorf("startJob started a cancelled job")
+	}
+	jm.SetJobError(queued.ID, errors.New("ffmpeg was stopped"))
+	if job, _ := jm.GetJob(queued.ID); job.Status != JobStatusCancelled {
+		t.Errorf("job status = %q, want %q", job.Status, JobStatusCancelled)
+	}
+
+	// Cancelling a running job cancels its context
+	running, _ := jm.CreateJob(JobRequest{Path: "/media/b.srt", TargetLanguages: []string{"pl"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := jm.startJob(running.ID, cancel); err != nil {
+		t.Fatalf("startJob failed: %v", err)
+	}
+	jm.CancelJob(running.ID)
+	if ctx.Err() == nil {
+		t.Errorf("cancelling a running job did not cancel its context")
+	}
+}
+
+// sliceCheckpoint is a checkpoint kept in a slice
+type sliceCheckpoint struct {
+	translations []Subtitle
+}
+
+func (c *sliceCheckpoint) Load() ([]Subtitle, error) {
+	return c.translations, nil
+}
+
+func (c *sliceCheckpoint) Save(translations []Subtitle) error {
+	c.translations = append(c.translations, translations...)
+	return nil
+}
+
+func TestTranslationCheckpoint(t *testing.T) {
+	subs := &astisub.Subtitles{}
+	for i, text := range []string{"One", "Two", "Three", "Four", "Five"} {
+		subs.Items = append(subs.Items, &astisub.Item{
+			Index: i + 1,
+			Lines: []astisub.Line{{Items: []astisub.LineItem{{Text: text}}}},
+		})
+	}
+
+	// The first batch was translated before the job was interrupted
+	line := func(text string) []Line { return []Line{{Items: []LineItem{{Text: text}}}} }
+	checkpoint := &sliceCheckpoint{translations: []Subtitle{
+		{Index: 1, Lines: line("Jeden")},
+		{Index: 2, Lines: line("Dwa")},
+	}}
+
+	config := DefaultTranslationConfig()
+	config.BatchSize = 2
+	backend := &countingBackend{}
+	translator := NewTranslatorWithBackend(backend, config)
+	translator.SetCheckpoint(checkpoint)
+
+	if err := translator.TranslateSubtitles(context.Background(), subs); err != nil {
+		t.Fatalf("TranslateSubtitles failed: %v", err)
+	}
+	if translated := backend.translated.Load(); translated != 3 {
+		t.Errorf("backend translated %d subtitles, want 3", translated)
+	}
+	if text := subs.Items[0].Lines[0].Items[0].Text; text != "Jeden" {
+		t.Errorf("subtitle 1 = %q, want the checkpointed translation", text)
+	}
+	if len(checkpoint.translations) != 5 {
+		t.Errorf("checkpoint holds %d translations, want 5", len(checkpoint.translations))
+	}
+}
+
+// recordingBackend returns its input unchanged, recording the requests. It
+// reports requests of more than maxSize subtitles as truncated, if set.
+type recordingBackend struct {
+	maxSize  int
+	requests []BatchRequest
+	mutex    sync.Mutex
+}
+
+func (b *recordingBackend) Name() string { return "test" }
+
+func (b *recordingBackend) TranslateBatch(ctx context.Context, request BatchRequest) ([]Subtitle, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.requests = append(b.requests, request)
+	if b.maxSize > 0 && len(request.Subtitles) > b.maxSize {
+		return nil, ErrTruncatedResponse
+	}
+	return request.Subtitles, nil
+}
+
+// request returns the recorded request for the subtitles with the given indexes
+func (b *recordingBackend) request(indexes ...int) (BatchRequest, bool) {
+	for _, request := range b.requests {
+		if slices.Equal(subtitleIndexes(request.Subtitles), indexes) {
+			return request, true
+		}
+	}
+	return BatchRequest{}, false
+}
+
+func subtitleIndexes(subs []Subtitle) []int {
+	var indexes []int
+	for _, sub := range subs {
+		indexes = append(indexes, sub.Index)
+	}
+	return indexes
+}
+
+func TestTranslationContext(t *testing.T) {
+	newSubtitles := func() *astisub.Subtitles {
+		subs := &astisub.Subtitles{}
+		for i := range 10 {
+			subs.Items = append(subs.Items, &astisub.Item{
+				Index: i + 1,
+				Lines: []astisub.Line{{Items: []astisub.LineItem{{Text: fmt.Sprintf("Line %d", i+1)}}}},
+			})
+		}
+		return subs
+	}
+
+	config := DefaultTranslationConfig()
+	config.BatchSize = 4
+	config.ContextBefore = 2
+	config.ContextAfter = 1
+	config.ContextTranslations = true
+
+	tests := []struct {
+		name         string
+		maxSize      int
+		indexes      []int
+		before       []int
+		after        []int
+		translations []int
+	}{
+		{"middle batch", 0, []int{5, 6, 7, 8}, []int{3, 4}, []int{9}, []int{3, 4}},
+		{"last batch", 0, []int{9, 10}, []int{7, 8}, nil, []int{7, 8}},
+		{"first half of a split batch", 2, []int{5, 6}, []int{3, 4}, []int{7}, []int{3, 4}},
+		{"second half of a split batch", 2, []int{7, 8}, []int{5, 6}, []int{9}, []int{5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &recordingBackend{maxSize: tt.maxSize}
+			translator := NewTranslatorWithBackend(backend, config)
+			if err := translator.TranslateSubtitles(context.Background(), newSubtitles()); err != nil {
+				t.Fatalf("TranslateSubtitles failed: %v", err)
+			}
+
+			request, found := backend.request(tt.indexes...)
+			if !found {
+				t.Fatalf("no request for subtitles %v", tt.indexes)
+			}
+			if got := subtitleIndexes(request.ContextBefore); !slices.Equal(got, tt.before) {
+				t.Errorf("context before = %v, want %v", got, tt.before)
+			}
+			if got := subtitleIndexes(request.ContextAfter); !slices.Equal(got, tt.after) {
+				t.Errorf("context after = %v, want %v", got, tt.after)
+			}
+			if got := subtitleIndexes(request.PreviousTranslations); !slices.Equal(got, tt.translations) {
+				t.Errorf("previous translations = %v, want %v", got, tt.translations)
+			}
+		})
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	jm := NewJobManagerWithStore(nil, false)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	paths := []string{"/media/anime/a.mkv", "/media/movies/b.mkv", "/media/anime/c.mkv", "/media/animex/d.mkv"}
+	var ids []string
+	for i, path := range paths {
+		job, _ := jm.CreateJob(JobRequest{Path: path, TargetLanguages: []string{"pl"}})
+		job.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		ids = append(ids, job.ID)
+	}
+	jm.SetJobError(ids[0], errors.New("no subtitle tracks"))
+	jm.SetJobError(ids[1], errors.New("no subtitle tracks"))
+
+	jobs, total := jm.ListJobs(JobFilter{MediaRoot: "/media/anime"})
+	if total != 2 || jobs[0].Path != paths[0] || jobs[1].Path != paths[2] {
+		t.Errorf("ListJobs in media root returned %d jobs: %v", total, jobs)
+	}
+
+	jobs, total = jm.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusFailed}, Descending: true, Limit: 1})
+	if total != 2 || len(jobs) != 1 || jobs[0].ID != ids[1] {
+		t.Errorf("ListJobs of failed jobs returned %d jobs, first %v", total, jobs)
+	}
+
+	jobs, _ = jm.ListJobs(JobFilter{CreatedAfter: base.Add(time.Hour), CreatedBefore: base.Add(3 * time.Hour), Offset: 1})
+	if len(jobs) != 1 || jobs[0].ID != ids[2] {
+		t.Errorf("ListJobs in created range with offset returned %v", jobs)
+	}
+
+	if err := jm.RetryJob(ids[2]); !errors.Is(err, ErrJobNotRetryable) {
+		t.Errorf("retrying a pending job returned %v, want ErrJobNotRetryable", err)
+	}
+	if err := jm.RetryJob(ids[0]); err != nil {
+		t.Fatalf("RetryJob failed: %v", err)
+	}
+	if job, _ := jm.GetJob(ids[0]); job.Status != JobStatusPending || job.Result.Error != "" {
+		t.Errorf("retried job = %+v, want pending without error", job)
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+	jm := NewJobManagerWithStore(nil, false)
+	all, unsubscribeAll := jm.Subscribe("")
+	defer unsubscribeAll()
+
+	job, _ := jm.CreateJob(JobRequest{Path: "/media/a.srt", TargetLanguages: []string{"pl"}})
+	events, unsubscribe := jm.Subscribe(job.ID)
+	jm.CreateJob(JobRequest{Path: "/media/b.srt", TargetLanguages: []string{"pl"}})
+
+	jm.UpdateJobStatus(job.ID, JobStatusTranslating)
+	jm.UpdateJobProgress(job.ID, 50)
+	jm.SetJobResult(job.ID, []JobOutput{{Language: "pl", OutputPath: "/media/a.pl.srt"}})
+	jm.UpdateJobProgress(job.ID, 99) // Late update after the job finished
+	unsubscribe()
+
+	var received []string
+	for event := range events {
+		if event.Job.ID != job.ID {
+			t.Errorf("received event of job %s, want only %s", event.Job.ID, job.ID)
+		}
+		received = append(received, fmt.Sprintf("%s:%s:%.0f", event.Type, event.Job.Status, event.Job.Progress))
+	}
+	expected := "[status:pending:0 status:translating:0 progress:translating:50 status:completed:100]"
+	if fmt.Sprint(received) != expected {
+		t.Errorf("received events %v, want %s", received, expected)
+	}
+
+	if len(all) != 5 {
+		t.Errorf("all jobs subscriber received %d events, want 5", len(all))
+	}
+	if event := <-all; event.Job.ID != job.ID {
+		t.Errorf("first event is for job %s, want %s", event.Job.ID, job.ID)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type delivery struct {
+		event, signature string
+		body             []byte
+	}
+	deliveries := make(chan delivery, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		attempts++
+		if attempts == 1 {
+			// First delivery fails and is retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- delivery{r.Header.Get(WebhookEventHeader), r.Header.Get(WebhookSignatureHeader), body}
+	}))
+	defer server.Close()
+
+	dispatcher := NewWebhookDispatcher([]WebhookConfig{{
+		URL:    server.URL,
+		Events: []string{WebhookJobCompleted},
+		Secret: "secret",
+	}})
+	dispatcher.retryBaseDelay = time.Millisecond
+
+	jm := NewJobManagerWithStore(nil, false)
+	jm.webhooks = dispatcher
+	job, _ := jm.CreateJob(JobRequest{Path: "/media/a.srt", TargetLanguages: []string{"pl"}})
+	jm.SetJobResult(job.ID, []JobOutput{{Language: "pl", OutputPath: "/media/a.pl.srt"}})
+
+	select {
+	case received := <-deliveries:
+		if received.event != WebhookJobCompleted {
+			t.Errorf("event header = %q, want %q", received.event, WebhookJobCompleted)
+		}
+		if expected := "sha256=" + signWebhookBody("secret", received.body); received.signature != expected {
+			t.Errorf("signature = %q, want %q", received.signature, expected)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(received.body, &payload); err != nil {
+			t.Fatalf("invalid payload: %v", err)
+		}
+		if payload.Job == nil || payload.Job.ID != job.ID || payload.OutputPath != "/media/a.pl.srt" {
+			t.Errorf("payload = %+v, want job %s with output /media/a.pl.srt", payload, job.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	select {
+	case received := <-deliveries:
+		t.Errorf("unexpected delivery of %s", received.event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := (WebhookConfig{URL: server.URL, Events: []string{"job.unknown"}}).validate(); err == nil {
+		t.Error("expected error for unknown event")
+	}
+	for _, invalid := range []string{"example.com/hook", "ftp://example.com/hook", "http://[::1"} {
+		if err := (WebhookConfig{URL: invalid}).validate(); err == nil {
+			t.Errorf("expected error for url %q", invalid)
+		}
+	}
+
+	// Requests that cannot be built are not retried
+	dispatcher.retryBaseDelay = time.Hour
+	delivered := make(chan struct{})
+	go func() {
+		dispatcher.deliver(WebhookConfig{URL: "http://[::1"}, WebhookJobCompleted, nil)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Error("delivery with an invalid url was retried")
+	}
+}
+
+func TestDuplicateJobs(t *testing.T) {
+	jm := NewJobManagerWithStore(nil, false)
+	jm.duplicateWindow = time.Hour
+
+	request := JobRequest{Path: "/media/a.mkv", TrackIndex: 2, TargetLanguages: []string{"pl", "de"}}
+	first, created := jm.CreateJob(request)
+	if !created {
+		t.Fatal("first job was not created")
+	}
+
+	reordered := request
+	reordered.TargetLanguages = []string{"de", "pl"}
+	if job, created := jm.CreateJob(reordered); created || job.ID != first.ID {
+		t.Errorf("equivalent request created job %s, want existing %s", job.ID, first.ID)
+	}
+
+	// Languages already being translated are left out of new jobs
+	subset := request
+	subset.TargetLanguages = []string{"pl"}
+	if job, created := jm.CreateJob(subset); created || job.ID != first.ID {
+		t.Errorf("request for a subset of languages created job %s, want existing %s", job.ID, first.ID)
+	}
+	overlapping := request
+	overlapping.TargetLanguages = []string{"de", "cs"}
+	czech, coveredBy, created := jm.CreateJobForLanguages(overlapping)
+	if !created || !slices.Equal(czech.TargetLanguages, []string{"cs"}) {
+		t.Errorf("overlapping request returned job for %v, want a new job for [cs]", czech.TargetLanguages)
+	}
+	if len(coveredBy) != 1 || coveredBy["de"] != first.ID {
+		t.Errorf("overlapping request covered by %v, want de by %s", coveredBy, first.ID)
+	}
+
+	// Languages translated by several jobs together return the newest one
+	job, coveredBy, created := jm.CreateJobForLanguages(overlapping)
+	if created || job.ID != czech.ID || len(coveredBy) != 1 || coveredBy["de"] != first.ID {
+		t.Errorf("repeated overlapping request returned job %s covered by %v, want %s and de by %s",
+			job.ID, coveredBy, czech.ID, first.ID)
+	}
+
+	otherTrack := request
+	otherTrack.TrackIndex = 3
+	if _, created := jm.CreateJob(otherTrack); !created {
+		t.Error("request for another track was deduplicated")
+	}
+
+	forced := request
+	forced.Force = true
+	second, created := jm.CreateJob(forced)
+	if !created {
+		t.Fatal("forced request was deduplicated")
+	}
+
+	// Recently completed jobs are returned, failed ones are not
+	jm.SetJobError(first.ID, errors.New("failed"))
+	jm.SetJobResult(second.ID, []JobOutput{{Language: "pl", OutputPath: "/media/a.pl.srt"}, {Language: "de", OutputPath: "/media/a.de.srt"}})
+	if job, _ := jm.CreateJob(request); job.ID != second.ID {
+		t.Errorf("request after completion returned job %s, want %s", job.ID, second.ID)
+	}
+
+	jm.duplicateWindow = 0
+	if _, created := jm.CreateJob(request); !created {
+		t.Error("completed job outside the window was returned")
+	}
+}
+
+func TestParseProbeStreams(t *testing.T) {
+	// Output of ffprobe with the arguments used by ListSubtitleTracks for a
+	// Matroska file, trimmed to the fields that are read
+	output := `{
+		"streams": [
+			{
+				"index": 2,
+				"codec_name": "subrip",
+				"codec_long_name": "SubRip subtitle",
+				"codec_type": "subtitle",
+				"time_base": "1/1000",
+				"start_pts": 0,
+				"duration_ts": 1420480,
+				"disposition": {"default": 1, "dub": 0, "original": 0, "comment": 0, "lyrics": 0,
+					"karaoke": 0, "forced": 0, "hearing_impaired": 0, "visual_impaired": 0},
+				"tags": {"language": "eng", "title": "English", "BPS-eng": "61", "NUMBER_OF_FRAMES-eng": "1024"}
+			},
+			{
+				"index": 3,
+				"codec_name": "hdmv_pgs_subtitle",
+				"codec_long_name": "HDMV Presentation Graphic Stream subtitles",
+				"codec_type": "subtitle",
+				"time_base": "1/1000",
+				"start_pts": 0,
+				"disposition": {"default": 0, "dub": 0, "original": 0, "comment": 0, "lyrics": 0,
+					"karaoke": 0, "forced": 1, "hearing_impaired": 0, "visual_impaired": 0},
+				"tags": {"LANGUAGE": "eng", "title": "Forced"}
+			},
+			{
+				"index": 4,
+				"codec_name": "ass",
+				"codec_long_name": "ASS (Advanced SSA) subtitle",
+				"codec_type": "subtitle",
+				"time_base": "1/1000",
+				"start_pts": 0,
+				"disposition": {"default": 0, "dub": 0, "original": 0, "comment": 0, "lyrics": 0,
+					"karaoke": 0, "forced": 0, "hearing_impaired": 1, "visual_impaired": 0},
+				"tags": {"title": "French SDH", "NUMBER_OF_FRAMES": "512"}
+			}
+		]
+	}`
+
+	tracks, err := parseProbeStreams([]byte(output))
+	if err != nil {
+		t.Fatalf("parseProbeStreams: %v", err)
+	}
+	expected := []SubtitleTrack{
+		{Index: 0, StreamIndex: 2, Language: "eng", Format: "subrip", CodecLongName: "SubRip subtitle",
+			Title: "English", Default: true, Frames: 1024, Text: true},
+		{Index: 1, StreamIndex: 3, Language: "eng", Format: "hdmv_pgs_subtitle",
+			CodecLongName: "HDMV Presentation Graphic Stream subtitles", Title: "Forced", Forced: true},
+		{Index: 2, StreamIndex: 4, Language: normalizeLanguageCode("French SDH"), Format: "ass",
+			CodecLongName: "ASS (Advanced SSA) subtitle", Title: "French SDH", HearingImpaired: true,
+			Frames: 512, Text: true},
+	}
+	if len(tracks) != len(expected) {
+		t.Fatalf("got %d tracks, want %d", len(tracks), len(expected))
+	}
+	for i := range expected {
+		if tracks[i] != expected[i] {
+			t.Errorf("track %d = %+v, want %+v", i, tracks[i], expected[i])
+		}
+	}
+
+	if _, err := parseProbeStreams([]byte("Input #0, matroska")); err == nil {
+		t.Error("expected error for non-JSON output")
+	}
+}
+
+func TestSubtitleTrackJSON(t *testing.T) {
+	track := SubtitleTrack{Index: 1, StreamIndex: 3, Language: "eng", Format: "subrip", CodecLongName: "SubRip subtitle",
+		Title: "English SDH", HearingImpaired: true, Frames: 1024, Text: true}
+	encoded, err := json.Marshal(track)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `{"track_index":1,"stream_index":3,"language":"eng","format":"subrip",` +
+		`"codec_long_name":"SubRip subtitle","title":"English SDH","default":false,"forced":false,` +
+		`"hearing_impaired":true,"comment":false,"frames":1024,"text":true}`
+	if string(encoded) != expected {
+		t.Errorf("encoded track =\n%s\nwant\n%s", encoded, expected)
+	}
+
+	// Fields shared with SubtitleInfo use the same names
+	streamIndex := 3
+	encodedInfo, _ := json.Marshal(SubtitleInfo{StreamIndex: &streamIndex, CodecLongName: "SubRip subtitle", Title: "English SDH"})
+	var trackFields, infoFields map[string]any
+	json.Unmarshal(encoded, &trackFields)
+	json.Unmarshal(encodedInfo, &infoFields)
+	for name := range trackFields {
+		if _, found := infoFields[name]; !found && name != "frames" {
+			t.Errorf("track field %q is not a SubtitleInfo field", name)
+		}
+	}
+}
+
+func TestSelectSubtitles(t *testing.T) {
+	index := func(n int) *int { return &n }
+	subtitles := []SubtitleInfo{
+		{TrackIndex: 0, StreamIndex: index(2), Language: "en", Format: "hdmv_pgs_subtitle", Embedded: true},
+		{TrackIndex: 1, StreamIndex: index(3), Language: "en", Format: "subrip", Embedded: true, Forced: true, Text: true},
+		{TrackIndex: 2, StreamIndex: index(4), Language: "fr", Format: "subrip", Embedded: true, Text: true},
+		{TrackIndex: 3, StreamIndex: index(5), Language: "en", Format: "subrip", Embedded: true, HearingImpaired: true, Text: true},
+		{TrackIndex: 4, StreamIndex: index(6), Language: "en", Format: "subrip", Embedded: true, Text: true},
+		{TrackIndex: 5, StreamIndex: index(7), Language: "de", Format: "hdmv_pgs_subtitle", Embedded: true},
+		{Path: "/media/movie.en.srt", Language: "en", Format: "subrip", Text: true},
+	}
+
+	describe := func(sub SubtitleInfo) string {
+		if sub.Embedded {
+			return fmt.Sprintf("track %d", sub.TrackIndex)
+		}
+		return sub.Path
+	}
+
+	tests := []struct {
+		name     string
+		policy   func(*TrackSelectionConfig)
+		expected string
+	}{
+		{"defaults prefer external full text", func(c *TrackSelectionConfig) {}, "/media/movie.en.srt"},
+		{"embedded", func(c *TrackSelectionConfig) { c.PreferExternal = false }, "track 4"},
+		{"sdh", func(c *TrackSelectionConfig) { c.PreferExternal = false; c.PreferSDH = true }, "track 3"},
+		{"language order", func(c *TrackSelectionConfig) { c.Languages = []string{"fra", "en"} }, "track 2"},
+		{"forced allowed", func(c *TrackSelectionConfig) { c.PreferExternal = false; c.AvoidForced = false }, "track 1"},
+		{"images allowed", func(c *TrackSelectionConfig) { c.PreferExternal = false; c.PreferText = false }, "track 0"},
+		{"language before text", func(c *TrackSelectionConfig) { c.Languages = []string{"de", "en"} }, "track 5"},
+		{"unlisted languages skipped", func(c *TrackSelectionConfig) { c.Languages = []string{"es"} }, ""},
+		{"any language", func(c *TrackSelectionConfig) { c.Languages = []string{"es"}; c.AnyLanguage = true }, "/media/movie.en.srt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultTrackSelectionConfig()
+			tt.policy(&policy)
+			selected, found := policy.Select(subtitles)
+			if !found {
+				if tt.expected != "" {
+					t.Errorf("no subtitles selected, want %s", tt.expected)
+				}
+				return
+			}
+			if describe(selected) != tt.expected {
+				t.Errorf("selected %s, want %s", describe(selected), tt.expected)
+			}
+		})
+	}
+
+	if _, found := DefaultTrackSelectionConfig().Select(nil); found {
+		t.Error("selected subtitles from an empty list")
+	}
+
+	// Earlier translations into the target languages are not sources
+	candidates := withoutTranslations([]SubtitleInfo{
+		{Path: "/media/movie.en.srt", Language: "en"},
+		{Path: "/media/movie.pl.srt", Language: "pl"},
+		{Path: "/media/movie_pol.forced.srt", Language: "pl"},
+		{TrackIndex: 2, Language: "pl", Embedded: true},
+	}, []string{"pl", "de"})
+	if len(candidates) != 2 || candidates[0].Path != "/media/movie.en.srt" || !candidates[1].Embedded {
+		t.Errorf("withoutTranslations = %+v, want the English file and the embedded track", candidates)
+	}
+}
+
+func TestBitmapSubtitles(t *testing.T) {
+	for codec, text := range map[string]bool{
+		"subrip":            true,
+		"ASS":               true,
+		"mov_text":          true,
+		"webvtt":            true,
+		"hdmv_pgs_subtitle": false,
+		"dvd_subtitle":      false,
+		"dvb_subtitle":      false,
+	} {
+		if isTextSubtitleCodec(codec) != text {
+			t.Errorf("isTextSubtitleCodec(%q) = %v, want %v", codec, !text, text)
+		}
+	}
+
+	err := fmt.Errorf("job failed: %w", &BitmapSubtitleError{Path: "/media/movie.mkv", TrackIndex: 1, Codec: "hdmv_pgs_subtitle"})
+	var bitmapErr *BitmapSubtitleError
+	if !errors.As(err, &bitmapErr) || bitmapErr.Codec != "hdmv_pgs_subtitle" {
+		t.Errorf("errors.As(%v) did not find the bitmap subtitle error", err)
+	}
+}
+
+func TestMuxSubtitles(t *testing.T) {
+	subtitles := []MuxedSubtitle{
+		{Path: "/media/movie.pl.srt", Language: "pol", Title: "Polish (AI)", Default: true},
+		{Path: "/media/movie.de.ass", Language: "ger", Title: "German (AI)"},
+	}
+
+	existing := []SubtitleTrack{
+		{Index: 0, Language: "eng", Title: "English", Default: true, Forced: true},
+		{Index: 1, Language: "eng", Title: "English SDH", HearingImpaired: true},
+	}
+	args, err := muxArgs("/media/movie.mkv", "/media/movie.ai.mkv", existing, subtitles)
+	if err != nil {
+		t.Fatalf("muxArgs: %v", err)
+	}
+	expected := "[-y -i /media/movie.mkv -i /media/movie.pl.srt -i /media/movie.de.ass -map 0 -map 1:s:0 -map 2:s:0 -c copy " +
+		"-disposition:s:0 forced " +
+		"-c:s:2 copy -metadata:s:s:2 language=pol -metadata:s:s:2 title=Polish (AI) -disposition:s:2 default " +
+		"-c:s:3 copy -metadata:s:s:3 language=ger -metadata:s:s:3 title=German (AI) -disposition:s:3 0 /media/movie.ai.mkv]"
+	if fmt.Sprint(args) != expected {
+		t.Errorf("muxArgs =\n%v\nwant\n%s", args, expected)
+	}
+
+	// Tracks added by an earlier run are replaced
+	existing = append(existing, SubtitleTrack{Index: 2, Language: "pol", Title: "Polish (AI)", Default: true})
+	args, _ = muxArgs("/media/movie.mkv", "/media/movie.mkv", existing, subtitles[:1])
+	expected = "[-y -i /media/movie.mkv -i /media/movie.pl.srt -map 0 -map -0:s:2 -map 1:s:0 -c copy " +
+		"-disposition:s:0 forced " +
+		"-c:s:2 copy -metadata:s:s:2 language=pol -metadata:s:s:2 title=Polish (AI) -disposition:s:2 default /media/movie.mkv]"
+	if fmt.Sprint(args) != expected {
+		t.Errorf("muxArgs with earlier tracks =\n%v\nwant\n%s", args, expected)
+	}
+
+	args, _ = muxArgs("/media/movie.mp4", "/media/movie.ai.mp4", nil, subtitles[:1])
+	if fmt.Sprint(args[11:13]) != "[-c:s:0 mov_text]" {
+		t.Errorf("MP4 subtitle codec args = %v, want mov_text", args[11:13])
+	}
+	if _, err := muxArgs("/media/movie.avi", "/media/movie.ai.avi", nil, subtitles); err == nil {
+		t.Error("expected error for AVI output")
+	}
+
+	tests := []struct {
+		output   OutputConfig
+		expected string
+	}{
+		{OutputConfig{Mode: OutputModeMuxCopy}, "/media/show/ep01.ai.mkv"},
+		{OutputConfig{Mode: OutputModeMuxCopy, Directory: "translated"}, "/media/show/translated/ep01.ai.mkv"},
+		{OutputConfig{Mode: OutputModeMuxReplace, Directory: "translated"}, "/media/show/ep01.mkv"},
+	}
+	for _, tt := range tests {
+		if path := muxedOutputPath("/media/show/ep01.mkv", tt.output); path != tt.expected {
+			t.Errorf("muxedOutputPath(%+v) = %s, want %s", tt.output, path, tt.expected)
+		}
+	}
+}
+
+func TestMuxFailure(t *testing.T) {
+	jm := NewJobManagerWithStore(nil, false)
+	job, _ := jm.CreateJob(JobRequest{Path: "/media/movie.mkv", TargetLanguages: []string{"pl"}})
+
+	// Subtitle files written before muxing failed are kept
+	jm.SetJobMuxResult(job.ID, "", errors.New("ffmpeg failed"))
+	jm.SetJobResult(job.ID, []JobOutput{{Language: "pl", OutputPath: "/media/movie.pl.srt"}})
+	job, _ = jm.GetJob(job.ID)
+	if job.Status != JobStatusPartial {
+		t.Errorf("job status = %q, want %q", job.Status, JobStatusPartial)
+	}
+	if len(job.Result.Outputs) != 1 || job.Result.OutputPath != "/media/movie.pl.srt" {
+		t.Errorf("job outputs = %+v, want the subtitle file", job.Result.Outputs)
+	}
+	if job.Result.MuxError != "ffmpeg failed" || job.Result.Error != "mux: ffmpeg failed" {
+		t.Errorf("job errors = %q and %q, want the mux error", job.Result.MuxError, job.Result.Error)
+	}
+}
+
+func TestDefaultTrackOverride(t *testing.T) {
+	enabled, disabled := true, false
+	config := newDefaultConfig()
+	config.Output.DefaultTrack = &enabled
+	config.MediaPaths["anime"] = MediaPathConfig{Path: "/media/anime", Output: OutputConfig{DefaultTrack: &disabled}}
+	config.MediaPaths["movies"] = MediaPathConfig{Path: "/media/movies"}
+
+	if !config.outputConfigForFile("/media/movies/a.mkv").defaultTrack() {
+		t.Error("media path without an override did not inherit the default track setting")
+	}
+	if config.outputConfigForFile("/media/anime/a.mkv").defaultTrack() {
+		t.Error("media path override did not disable the default track")
+	}
+}
+
+func TestBackendOverrides(t *testing.T) {
+	config := newDefaultConfig()
+	config.Translation.Backend = "openai"
+	config.MediaPaths["anime"] = MediaPathConfig{Path: "/media/anime", Backend: "local"}
+	config.MediaPaths["movies"] = MediaPathConfig{Path: "/media/movies"}
+
+	tests := []struct {
+		path, requested, expected string
+	}{
+		{"/media/movies/a.mkv", "", "openai"},
+		{"/media/anime/a.mkv", "", "local"},
+		{"/media/anime/a.mkv", "other", "other"},
+		{"/media/movies/a.mkv", "other", "other"},
+	}
+	for _, tt := range tests {
+		if backend := config.translationConfigForFile(tt.path, tt.requested).Backend; backend != tt.expected {
+			t.Errorf("backend for %s with request %q = %s, want %s", tt.path, tt.requested, backend, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// PromptVersion identifies the prompts sent to translation backends. It is
+// part of the translation memory key, so it must be increased whenever a
+// change to the prompts makes earlier translations worth redoing.
+const PromptVersion = "2"
+
+// UnknownLanguage is the source language recorded in the translation memory
+// when the language of the input cannot be determined
+const UnknownLanguage = "und"
+
+// TranslationMemory stores translations of previously translated subtitles
+type TranslationMemory interface {
+	// LookupTranslations returns the stored translations for the given
+	// normalized source texts, keyed by source text
+	LookupTranslations(key TranslationMemoryKey, sourceTexts []string) (map[string][]Line, error)
+	// StoreTranslations stores translations keyed by normalized source text
+	StoreTranslations(key TranslationMemoryKey, translations map[string][]Line) error
+}
+
+// memorySourceText normalizes the text of a subtitle for use as a translation
+// memory key. Whitespace is collapsed so that releases differing only in
+// spacing share translations, while the line and item layout is kept so that
+// a stored translation always fits the subtitle it is applied to.
+func memorySourceText(sub Subtitle) string {
+	lines := make([]string, len(sub.Lines))
+	for i, line := range sub.Lines {
+		items := make([]string, len(line.Items))
+		for j, item := range line.Items {
+			items[j] = strings.Join(strings.Fields(item.Text), " ")
+		}
+		lines[i] = strings.Join(items, "\x1f")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// memoryContextText extends the memory key of a subtitle with a digest of the
+// neighbouring subtitles sent as context with it, so that a translation made
+// for one scene is not reused for the same line in another one
+func memoryContextText(sourceText string, neighbours []Subtitle) string {
+	digest := sha256.New()
+	for _, sub := range neighbours {
+		digest.Write([]byte(memorySourceText(sub)))
+		digest.Write([]byte{0})
+	}
+	return sourceText + "\x1e" + hex.EncodeToString(digest.Sum(nil)[:16])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DefaultOutputTemplate replaces the language segment of the input name,
+// keeping its separator, e.g. movie.eng.hi.srt -> movie.pl.srt
+const DefaultOutputTemplate = "{base}{sep}{lang}{.ext}"
+
+// subtitleName describes the parts of a subtitle file name
+type subtitleName struct {
+	Base   string // File name without extension, language and type segments
+	Sep    string // Separator preceding the language segment
+	Ext    string // Extension without the leading dot
+	Lang   string // ISO 639-1 code of the language segment, empty if none
+	Forced bool   // Name contained a forced segment
+	SDH    bool   // Name contained a hearing impaired segment (hi, sdh, cc)
+}
+
+// outputNameTags maps subtitle type segments recognised in file names
+// to whether they mark forced (true) or hearing impaired (false) subtitles
+var outputNameTags = map[string]bool{
+	"forced": true,
+	"hi":     false,
+	"sdh":    false,
+	"cc":     false,
+}
+
+// parseSubtitleName splits a subtitle file name into its parts. Trailing
+// type segments are only removed together with a language segment, and
+// segments must be lower case, so that words in titles are left alone.
+func parseSubtitleName(fileName string) subtitleName {
+	name := subtitleName{Sep: "."}
+
+	stem := fileName
+	if dot := strings.LastIndex(fileName, "."); dot != -1 {
+		stem = fileName[:dot]
+		name.Ext = fileName[dot+1:]
+	}
+	name.Base = stem
+
+	var forced, sdh bool
+	for {
+		idx := strings.LastIndexAny(stem, "._")
+		if idx <= 0 {
+			return name
+		}
+
+		segment := stem[idx+1:]
+		if segment != strings.ToLower(segment) {
+			return name
+		}
+
+		// Subtitle type segments follow the language segment
+		if isForced, isTag := outputNameTags[segment]; isTag {
+			forced = forced || isForced
+			sdh = sdh || !isForced
+			stem = stem[:idx]
+			continue
+		}
+
+		if normalizeLanguageCode(segment) == "" {
+			return name
+		}
+
+		name.Base = stem[:idx]
+		name.Sep = stem[idx : idx+1]
+		name.Lang = normalizeLanguageCode(segment)
+		name.Forced = forced
+		name.SDH = sdh
+		return name
+	}
+}
+
+// renderOutputName fills the placeholders of an output naming template.
+// Placeholders starting with a dot expand to nothing when the value is empty.
+func renderOutputName(template string, name subtitleName, langCode string) string {
+	optional := func(value string, present bool) string {
+		if !present {
+			return ""
+		}
+		return "." + value
+	}
+
+	replacer := strings.NewReplacer(
+		"{base}", name.Base,
+		"{sep}", name.Sep,
+		"{lang}", langCode,
+		"{ext}", name.Ext,
+		"{.ext}", optional(name.Ext, name.Ext != ""),
+		"{.forced}", optional("forced", name.Forced),
+		"{.sdh}", optional("sdh", name.SDH),
+		"{.hi}", optional("hi", name.SDH),
+	)
+	return replacer.Replace(template)
+}
+
+// renderOutputPath creates the output path for a translation of inputPath
+// using the given naming configuration
+func renderOutputPath(inputPath string, langCode string, output OutputConfig) string {
+	template := output.Template
+	if template == "" {
+		template = DefaultOutputTemplate
+	}
+
+	fileName := renderOutputName(template, parseSubtitleName(filepath.Base(inputPath)), langCode)
+	return filepath.Join(outputDirectory(inputPath, output), fileName)
+}
+
+// outputDirectory returns the directory outputs for inputPath are written to
+func outputDirectory(inputPath string, output OutputConfig) string {
+	dir := filepath.Dir(inputPath)
+	if output.Directory != "" {
+		if filepath.IsAbs(output.Directory) {
+			dir = output.Directory
+		} else {
+			dir = filepath.Join(dir, output.Directory)
+		}
+	}
+	return dir
+}
+
+// muxedOutputPath returns the path of the video the translations of
+// videoPath are added to: the video itself in mux_replace mode, otherwise a
+// copy in the output directory named like movie.ai.mkv
+func muxedOutputPath(videoPath string, output OutputConfig) string {
+	if output.Mode == OutputModeMuxReplace {
+		return videoPath
+	}
+	ext := filepath.Ext(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), ext)
+	return filepath.Join(outputDirectory(videoPath, output), base+".ai"+ext)
+}
+
+// deriveOutputPath creates the output path for a translation of inputPath
+// into the given language, using the naming template configured globally or
+// for the media path containing the input file. By default the language
+// segment of the input name (e.g. .eng, _en.hi, .fre) is replaced by the
+// language code, or the code is added before the extension.
+func deriveOutputPath(inputPath string, langCode string) string {
+	return renderOutputPath(inputPath, langCode, GetOutputConfig(inputPath))
+}
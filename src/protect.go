@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/asticode/go-astisub"
+)
+
+// placeholderPattern matches the placeholders that replace markup in the
+// text sent to the backend
+var placeholderPattern = regexp.MustCompile(`⟦(\d+)⟧`)
+
+// markupPattern matches markup left in subtitle text: ASS override blocks
+// such as {\an8} or {\i1} and HTML-like tags such as <i> or <font color="red">
+var markupPattern = regexp.MustCompile(`\{[^{}]*\}|</?[a-zA-Z][^<>]*>`)
+
+// placeholderInstructions explains the placeholders to the model
+const placeholderInstructions = `Subtitles may contain placeholders such as ⟦1⟧ ` +
+	`standing for formatting. Keep every placeholder exactly once in the same line, ` +
+	`around the translation of the words it surrounds in the source.`
+
+// protectedTag is the markup or item boundary replaced by a placeholder
+type protectedTag struct {
+	Markup string // Markup put back in place of the placeholder
+	Item   int    // Line item started or ended by the placeholder, if Markup is empty
+	Close  bool   // Placeholder ends the line item
+}
+
+// placeholder returns the placeholder with the given number
+func placeholder(n int) string {
+	return fmt.Sprintf("⟦%d⟧", n)
+}
+
+// protectItem converts a subtitle item to the form sent to the backend. Markup
+// in the text is replaced with numbered placeholders, and lines made of
+// several differently styled items are merged into a single text with
+// placeholders marking where each item starts and ends, so that the model can
+// reorder words freely. Numbering is deterministic, so restoreItem can
+// recompute the tags from the original item.
+func protectItem(item *astisub.Item) (Subtitle, map[int]protectedTag) {
+	tags := make(map[int]protectedTag)
+	add := func(tag protectedTag) string {
+		n := len(tags) + 1
+		tags[n] = tag
+		return placeholder(n)
+	}
+	protectMarkup := func(text string) string {
+		return markupPattern.ReplaceAllStringFunc(text, func(markup string) string {
+			return add(protectedTag{Markup: markup})
+		})
+	}
+
+	sub := Subtitle{Index: item.Index}
+	for _, line := range item.Lines {
+		var builder strings.Builder
+		for j, lineItem := range line.Items {
+			if len(line.Items) == 1 {
+				builder.WriteString(protectMarkup(lineItem.Text))
+				continue
+			}
+			builder.WriteString(add(protectedTag{Item: j}))
+			builder.WriteString(protectMarkup(lineItem.Text))
+			builder.WriteString(add(protectedTag{Item: j, Close: true}))
+		}
+
+		var items []LineItem
+		if len(line.Items) > 0 {
+			items = []LineItem{{Text: builder.String()}}
+		}
+		sub.Lines = append(sub.Lines, Line{Items: items})
+	}
+	return sub, tags
+}
+
+// restoreItem replaces the text of a subtitle item with its translation,
+// putting the protected markup back and splitting merged items again
+func restoreItem(item *astisub.Item, translation Subtitle) {
+	_, tags := protectItem(item)
+	for i, line := range item.Lines {
+		if i >= len(translation.Lines) || len(line.Items) == 0 {
+			continue
+		}
+		var text strings.Builder
+		for _, translatedItem := range translation.Lines[i].Items {
+			text.WriteString(translatedItem.Text)
+		}
+		item.Lines[i].Items = restoreLine(line.Items, text.String(), tags)
+	}
+}
+
+// restoreLine splits the translated text of a line into items styled like
+// the original ones. Text the model placed outside of any item is kept
+// without inline style.
+func restoreLine(original []astisub.LineItem, text string, tags map[int]protectedTag) []astisub.LineItem {
+	var items []astisub.LineItem
+	var builder strings.Builder
+
+	// Item being restored, -1 outside of any item
+	current := -1
+	if len(original) == 1 {
+		current = 0
+	}
+
+	flush := func() {
+		text := builder.String()
+		builder.Reset()
+		if current >= 0 {
+			item := original[current]
+			item.Text = text
+			items = append(items, item)
+		} else if text != "" {
+			items = append(items, astisub.LineItem{Style: original[0].Style, Text: text})
+		}
+	}
+
+	position := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(text, -1) {
+		builder.WriteString(text[position:match[0]])
+		position = match[1]
+
+		n, _ := strconv.Atoi(text[match[2]:match[3]])
+		tag, known := tags[n]
+		switch {
+		case !known:
+			// Dropped, validation only lets through placeholders of the source
+		case tag.Markup != "":
+			builder.WriteString(tag.Markup)
+		case tag.Close:
+			flush()
+			current = -1
+		default:
+			flush()
+			current = tag.Item
+		}
+	}
+	builder.WriteString(text[position:])
+	flush()
+
+	return items
+}
+
+// linePlaceholders returns the placeholders used in a line, sorted
+func linePlaceholders(line Line) []string {
+	var placeholders []string
+	for _, item := range line.Items {
+		placeholders = append(placeholders, placeholderPattern.FindAllString(item.Text, -1)...)
+	}
+	slices.Sort(placeholders)
+	return placeholders
+}
+
+// containsPlaceholders reports whether any of the subtitles has placeholders
+func containsPlaceholders(subtitles []Subtitle) bool {
+	for _, sub := range subtitles {
+		for _, line := range sub.Lines {
+			if len(linePlaceholders(line)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when a job cannot be queued because the queue
+// already holds the configured number of jobs
+var ErrQueueFull = errors.New("job queue is full")
+
+// queuedJob is an entry of the job queue
+type queuedJob struct {
+	id       string
+	priority int
+	sequence uint64 // Order of submission, keeps jobs of equal priority FIFO
+}
+
+// jobHeap orders queued jobs by descending priority, then by submission
+type jobHeap []queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x any) { *h = append(*h, x.(queuedJob)) }
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// JobQueue holds the IDs of jobs waiting for a worker. Jobs with a higher
+// priority are taken first, jobs of the same priority in submission order.
+type JobQueue struct {
+	mutex    sync.Mutex
+	ready    *sync.Cond
+	jobs     jobHeap
+	sequence uint64
+	capacity int // Maximum number of queued jobs, 0 for no limit
+}
+
+// NewJobQueue creates a queue holding at most capacity jobs, or any number
+// of jobs if capacity is 0
+func NewJobQueue(capacity int) *JobQueue {
+	q := &JobQueue{capacity: capacity}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push adds a job to the queue
+func (q *JobQueue) Push(id string, priority int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.capacity > 0 && len(q.jobs) >= q.capacity {
+		return ErrQueueFull
+	}
+
+	q.sequence++
+	heap.Push(&q.jobs, queuedJob{id: id, priority: priority, sequence: q.sequence})
+	q.ready.Signal()
+	return nil
+}
+
+// Pop removes the next job from the queue, waiting until there is one
+func (q *JobQueue) Pop() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.jobs) == 0 {
+		q.ready.Wait()
+	}
+	return heap.Pop(&q.jobs).(queuedJob).id
+}
+
+// Len returns the number of queued jobs
+func (q *JobQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.jobs)
+}
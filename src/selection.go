@@ -0,0 +1,152 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// ErrNoSubtitles is returned when a video has no subtitles to translate
+var ErrNoSubtitles = errors.New("no subtitles found")
+
+// TrackSelectionConfig chooses the subtitles to translate when a request
+// does not name a track. Criteria are applied in the order of the fields.
+type TrackSelectionConfig struct {
+	Languages      []string `yaml:"languages"`       // Source languages, most preferred first, any if empty
+	AnyLanguage    bool     `yaml:"any_language"`    // Fall back to subtitles in other languages
+	PreferText     bool     `yaml:"prefer_text"`     // Prefer text subtitles over images
+	AvoidForced    bool     `yaml:"avoid_forced"`    // Prefer full subtitles over forced ones
+	PreferSDH      bool     `yaml:"prefer_sdh"`      // Prefer SDH subtitles, otherwise regular ones
+	PreferExternal bool     `yaml:"prefer_external"` // Prefer subtitle files, otherwise embedded tracks
+}
+
+// DefaultTrackSelectionConfig returns the default track selection policy
+func DefaultTrackSelectionConfig() TrackSelectionConfig {
+	return TrackSelectionConfig{
+		Languages:      []string{"en"},
+		AnyLanguage:    false,
+		PreferText:     true,
+		AvoidForced:    true,
+		PreferSDH:      false,
+		PreferExternal: true,
+	}
+}
+
+// Select returns the subtitles best matching the policy, or false if there
+// are none. Subtitles in unlisted languages are skipped unless AnyLanguage
+// is set. Commentary tracks come last, and among equally good subtitles
+// default tracks come first, then the first one listed.
+func (c TrackSelectionConfig) Select(subtitles []SubtitleInfo) (SubtitleInfo, bool) {
+	if len(c.Languages) > 0 && !c.AnyLanguage {
+		subtitles = slices.DeleteFunc(slices.Clone(subtitles), func(sub SubtitleInfo) bool {
+			return c.languageRank(sub.Language) == len(c.Languages)
+		})
+	}
+	if len(subtitles) == 0 {
+		return SubtitleInfo{}, false
+	}
+	return slices.MinFunc(subtitles, c.compare), true
+}
+
+// compare orders subtitles from the most to the least preferred
+func (c TrackSelectionConfig) compare(a, b SubtitleInfo) int {
+	return cmp.Or(
+		cmp.Compare(c.languageRank(a.Language), c.languageRank(b.Language)),
+		preferTrue(c.PreferText, a.Text, b.Text),
+		preferTrue(c.AvoidForced, !a.Forced, !b.Forced),
+		preferTrue(true, !a.Comment, !b.Comment),
+		preferTrue(true, a.HearingImpaired == c.PreferSDH, b.HearingImpaired == c.PreferSDH),
+		preferTrue(true, a.Embedded != c.PreferExternal, b.Embedded != c.PreferExternal),
+		preferTrue(true, a.Default, b.Default),
+	)
+}
+
+// languageRank returns the position of a language in the preferred
+// languages, or the number of preferred languages if it is not one of them
+func (c TrackSelectionConfig) languageRank(language string) int {
+	code := normalizeLanguageCode(language)
+	for i, preferred := range c.Languages {
+		if normalizeLanguageCode(preferred) == code {
+			return i
+		}
+	}
+	return len(c.Languages)
+}
+
+// preferTrue orders a true value before a false one, if enabled
+func preferTrue(enabled, a, b bool) int {
+	if !enabled || a == b {
+		return 0
+	}
+	if a {
+		return -1
+	}
+	return 1
+}
+
+// selectSourceSubtitles picks the subtitles of a media file to translate
+// into the target languages according to the policy. For videos it returns
+// either the video with the index of the selected embedded track, or the
+// selected subtitle file next to it. Subtitle files are returned unchanged.
+func selectSourceSubtitles(ctx context.Context, path string, policy TrackSelectionConfig, targetLanguages []string) (string, int, error) {
+	fileType, err := DetectFileType(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("error detecting file type: %w", err)
+	}
+	if !fileType.IsVideo() {
+		return path, 0, nil
+	}
+
+	ff, err := NewFFmpeg()
+	if err != nil {
+		return "", 0, fmt.Errorf("error initializing FFmpeg: %w", err)
+	}
+	subtitles, err := FindVideoSubtitles(ctx, ff, path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	selected, found := policy.Select(withoutTranslations(subtitles, targetLanguages))
+	if !found {
+		return "", 0, fmt.Errorf("%w for '%s'", ErrNoSubtitles, path)
+	}
+	if selected.Embedded {
+		return path, selected.TrackIndex, nil
+	}
+	return selected.Path, 0, nil
+}
+
+// withoutTranslations removes the subtitle files named as translations into
+// one of the target languages, such as the outputs of earlier jobs
+func withoutTranslations(subtitles []SubtitleInfo, targetLanguages []string) []SubtitleInfo {
+	return slices.DeleteFunc(slices.Clone(subtitles), func(sub SubtitleInfo) bool {
+		if sub.Embedded {
+			return false
+		}
+		name := parseSubtitleName(filepath.Base(sub.Path))
+		return name.Lang != "" && slices.Contains(targetLanguages, name.Lang)
+	})
+}
+
+// checkSourceTrack verifies that the subtitle track of a media file to
+// translate exists and stores text, so that requests for image-based tracks
+// fail before a job is created
+func checkSourceTrack(ctx context.Context, path string, trackIndex int) error {
+	fileType, err := DetectFileType(path)
+	if err != nil {
+		return fmt.Errorf("error detecting file type: %w", err)
+	}
+	if !fileType.IsVideo() {
+		return nil
+	}
+
+	ff, err := NewFFmpeg()
+	if err != nil {
+		return fmt.Errorf("error initializing FFmpeg: %w", err)
+	}
+	_, err = ff.TextSubtitleTrack(ctx, path, trackIndex)
+	return err
+}
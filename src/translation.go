@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/asticode/go-astisub"
 	"github.com/invopop/jsonschema"
-	"github.com/openai/openai-go"
 )
 
 // LineItem represents a single text item within a subtitle line
@@ -37,10 +44,25 @@ type TranslationResponse struct {
 
 // TranslationConfig holds configuration for translation operations
 type TranslationConfig struct {
-	BatchSize        int    // Number of subtitles to process in each batch
-	ConcurrencyLimit int    // Maximum number of concurrent translation requests
-	TargetLanguage   string // Target language for translation (default: "polish")
-	Model            string // OpenAI model to use
+	BatchSize        int    `yaml:"batch_size"`      // Number of subtitles to process in each batch
+	ConcurrencyLimit int    `yaml:"concurrency"`     // Maximum number of concurrent translation requests per translation
+	TargetLanguage   string `yaml:"target_language"` // Target language for translation (default: "polish")
+	Model            string `yaml:"model"`           // Model to use, defaults to the backend's model
+	Backend          string `yaml:"backend"`         // Name of the translation backend (default: "openai")
+
+	MaxRetries     int           `yaml:"max_retries"`      // Retries per batch before giving up
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"` // Delay before the first retry, doubled on each attempt
+	RetryMaxDelay  time.Duration `yaml:"retry_max_delay"`  // Upper bound for the delay between retries
+	AllowPartial   bool          `yaml:"allow_partial"`    // Write output even if some batches failed
+	RepairAttempts int           `yaml:"repair_attempts"`  // Re-requests of broken subtitles before splitting the batch
+
+	ContextBefore       int  `yaml:"context_before"`       // Preceding subtitles sent as read-only context
+	ContextAfter        int  `yaml:"context_after"`        // Following subtitles sent as read-only context
+	ContextTranslations bool `yaml:"context_translations"` // Also send translations of the preceding subtitles; batches then run one after another
+
+	Memory bool `yaml:"memory"` // Reuse translations stored in the database
+
+	GlobalConcurrency int `yaml:"global_concurrency"` // Maximum number of concurrent requests of all jobs together
 }
 
 // DefaultTranslationConfig returns a default configuration for translation
@@ -49,8 +71,54 @@ func DefaultTranslationConfig() TranslationConfig {
 		BatchSize:        30,
 		ConcurrencyLimit: 5,
 		TargetLanguage:   "polish",
-		Model:            openai.ChatModelGPT4oMini,
+		Model:            DefaultModel,
+		Backend:          DefaultBackendName,
+		MaxRetries:       5,
+		RetryBaseDelay:   time.Second,
+		RetryMaxDelay:    time.Minute,
+		AllowPartial:     false,
+		RepairAttempts:   2,
+		ContextBefore:    5,
+		ContextAfter:     3,
+		Memory:           true,
+
+		GlobalConcurrency: 5,
+	}
+}
+
+// Validate checks that the translation configuration is usable
+func (c TranslationConfig) Validate() error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive, got %d", c.BatchSize)
+	}
+	if c.ConcurrencyLimit <= 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", c.ConcurrencyLimit)
+	}
+	if normalizeLanguageCode(c.TargetLanguage) == "" {
+		return fmt.Errorf("unknown target language '%s'", c.TargetLanguage)
+	}
+	if c.GlobalConcurrency <= 0 {
+		return fmt.Errorf("global concurrency must be positive, got %d", c.GlobalConcurrency)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max retries cannot be negative, got %d", c.MaxRetries)
+	}
+	if c.ContextBefore < 0 || c.ContextAfter < 0 {
+		return fmt.Errorf("context sizes cannot be negative, got %d before and %d after",
+			c.ContextBefore, c.ContextAfter)
+	}
+	if c.RepairAttempts < 0 {
+		return fmt.Errorf("repair attempts cannot be negative, got %d", c.RepairAttempts)
 	}
+	if c.RetryBaseDelay <= 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("retry delays must be positive with max >= base, got base %s and max %s",
+			c.RetryBaseDelay, c.RetryMaxDelay)
+	}
+	if !slices.Contains(TranslationBackendNames(), c.Backend) {
+		return fmt.Errorf("unknown translation backend '%s', available: %s",
+			c.Backend, strings.Join(TranslationBackendNames(), ", "))
+	}
+	return nil
 }
 
 // GenerateSchema generates a JSON schema for the specified type
@@ -66,29 +134,69 @@ func GenerateSchema[T any]() any {
 	return schema
 }
 
+// PartialTranslationError is returned when some subtitles could not be
+// translated after all retries were exhausted
+type PartialTranslationError struct {
+	UntranslatedIndices []int // Indices of the cues left untranslated
+	Total               int   // Total number of cues
+	Err                 error // Last error returned by the backend
+}
+
+func (e *PartialTranslationError) Error() string {
+	return fmt.Sprintf("%d of %d subtitles could not be translated: %v",
+		len(e.UntranslatedIndices), e.Total, e.Err)
+}
+
+func (e *PartialTranslationError) Unwrap() error {
+	return e.Err
+}
+
 // TranslationResponseSchema is the JSON schema for the translation response
 var TranslationResponseSchema = GenerateSchema[TranslationResponse]()
 
 // Translator handles subtitle translation operations
 type Translator struct {
-	client          openai.Client
+	backend         TranslationBackend
 	config          TranslationConfig
 	progressChannel chan<- float64
+
+	glossary        []GlossaryEntry
+	violations      []GlossaryViolation
+	violationsMutex sync.Mutex
+
+	memory         TranslationMemory
+	sourceLanguage string
+	memoryHits     atomic.Int64
+	memoryMisses   atomic.Int64
+
+	limiter *RequestLimiter
+
+	checkpoint      Checkpoint
+	checkpointMutex sync.Mutex
+
+	// Neighbours of the subtitles being translated, sent as context
+	neighbours *neighbourContext
 }
 
 // NewTranslator creates a new Translator instance with the default configuration
-func NewTranslator() *Translator {
-	return &Translator{
-		client:          openai.NewClient(),
-		config:          DefaultTranslationConfig(),
-		progressChannel: nil,
+func NewTranslator() (*Translator, error) {
+	return NewTranslatorWithConfig(DefaultTranslationConfig())
+}
+
+// NewTranslatorWithConfig creates a new Translator with a custom configuration,
+// using the backend named in the configuration
+func NewTranslatorWithConfig(config TranslationConfig) (*Translator, error) {
+	backend, err := NewTranslationBackend(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create translation backend: %w", err)
 	}
+	return NewTranslatorWithBackend(backend, config), nil
 }
 
-// NewTranslatorWithConfig creates a new Translator with a custom configuration
-func NewTranslatorWithConfig(config TranslationConfig) *Translator {
+// NewTranslatorWithBackend creates a new Translator that uses the given backend
+func NewTranslatorWithBackend(backend TranslationBackend, config TranslationConfig) *Translator {
 	return &Translator{
-		client:          openai.NewClient(),
+		backend:         backend,
 		config:          config,
 		progressChannel: nil,
 	}
@@ -99,13 +207,66 @@ func (t *Translator) SetConfig(config TranslationConfig) {
 	t.config = config
 }
 
+// SetBackend replaces the backend used for translation
+func (t *Translator) SetBackend(backend TranslationBackend) {
+	t.backend = backend
+}
+
+// SetGlossary sets the glossary entries the translations must follow
+func (t *Translator) SetGlossary(entries []GlossaryEntry) {
+	t.glossary = entries
+}
+
+// GlossaryViolations returns the glossary violations found in the translations so far
+func (t *Translator) GlossaryViolations() []GlossaryViolation {
+	t.violationsMutex.Lock()
+	defer t.violationsMutex.Unlock()
+
+	violations := make([]GlossaryViolation, len(t.violations))
+	copy(violations, t.violations)
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].Index < violations[j].Index
+	})
+	return violations
+}
+
+// SetMemory sets the translation memory consulted before calling the backend
+func (t *Translator) SetMemory(memory TranslationMemory) {
+	t.memory = memory
+}
+
+// SetSourceLanguage sets the ISO 639-1 code of the language translated from,
+// used to look up translations in the translation memory
+func (t *Translator) SetSourceLanguage(langCode string) {
+	t.sourceLanguage = langCode
+}
+
+// MemoryStats returns the number of subtitles found in and missing from the
+// translation memory so far
+func (t *Translator) MemoryStats() (hits, misses int) {
+	return int(t.memoryHits.Load()), int(t.memoryMisses.Load())
+}
+
+// SetRequestLimiter sets a limiter shared with other translators that bounds
+// the number of concurrent backend requests
+func (t *Translator) SetRequestLimiter(limiter *RequestLimiter) {
+	t.limiter = limiter
+}
+
+// SetCheckpoint sets where the translations of finished batches are saved
+// and restored from
+func (t *Translator) SetCheckpoint(checkpoint Checkpoint) {
+	t.checkpoint = checkpoint
+}
+
 // SetProgressChannel sets a channel that will receive progress updates
 func (t *Translator) SetProgressChannel(progressChan chan<- float64) {
 	t.progressChannel = progressChan
 }
 
-// TranslateSubtitleFile translates subtitles from a file path
-func (t *Translator) TranslateSubtitleFile(inputPath, outputPath string) error {
+// TranslateSubtitleFile translates subtitles from a file path. Nothing is
+// written if the context is cancelled.
+func (t *Translator) TranslateSubtitleFile(ctx context.Context, inputPath, outputPath string) error {
 	// Load subtitle file for translation
 	subs, err := astisub.OpenFile(inputPath)
 	if err != nil {
@@ -114,62 +275,102 @@ func (t *Translator) TranslateSubtitleFile(inputPath, outputPath string) error {
 
 	// If output path is empty, derive it from the input path
 	if outputPath == "" {
-		outputPath = deriveOutputPath(inputPath)
+		outputPath = deriveOutputPath(inputPath, normalizeLanguageCode(t.config.TargetLanguage))
 	}
 
-	// Translate the subtitles
-	err = t.TranslateSubtitles(subs)
-	if err != nil {
-		return fmt.Errorf("failed to translate subtitles: %w", err)
+	// Translate the subtitles, keeping partial results only if allowed
+	translateErr := t.TranslateSubtitles(ctx, subs)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if translateErr != nil {
+		var partialErr *PartialTranslationError
+		if !t.config.AllowPartial || !errors.As(translateErr, &partialErr) {
+			return fmt.Errorf("failed to translate subtitles: %w", translateErr)
+		}
+		slog.Warn("Writing partially translated subtitles", "path", outputPath,
+			"untranslated", len(partialErr.UntranslatedIndices))
 	}
 
 	// Save the translated subtitles to the output file
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
 	err = subs.Write(outputPath)
 	if err != nil {
 		return fmt.Errorf("failed to write output file: %w", err)
 	}
 
 	slog.Info("Translated subtitles saved", "path", outputPath)
-	return nil
+	return translateErr
 }
 
-// TranslateSubtitles translates the contents of an astisub.Subtitles object
-func (t *Translator) TranslateSubtitles(subs *astisub.Subtitles) error {
+// TranslateSubtitles translates the contents of an astisub.Subtitles object.
+// Batches that still fail after all retries are left untranslated and reported
+// through a PartialTranslationError. Only dialogue is translated, ASS drawings
+// and karaoke are kept as they are. When the context is cancelled no further
+// batches are started and the context's error is returned.
+func (t *Translator) TranslateSubtitles(ctx context.Context, subs *astisub.Subtitles) error {
+	ensureUniqueIndices(subs.Items)
+	items := dialogueItems(subs.Items)
+
 	batchSize := t.config.BatchSize
 	concurrencyLimit := t.config.ConcurrencyLimit
-	batchCount := int(math.Ceil(float64(len(subs.Items)) / float64(batchSize)))
-	
+	batchCount := int(math.Ceil(float64(len(items)) / float64(batchSize)))
+
 	// Create a semaphore to limit concurrency
 	semaphore := make(chan struct{}, concurrencyLimit)
 	var wg sync.WaitGroup
-	
+
 	// Channel to collect results from all goroutines
 	translationResultsChan := make(chan []Subtitle, batchCount+1)
-	
+
 	// Progress tracking
 	completedBatches := 0
 	var progressMutex sync.Mutex
-	
+
+	// Failed batch tracking
+	var failedIndices []int
+	var lastErr error
+	var failedMutex sync.Mutex
+
+	// Batches sending translations as context wait for the previous one
+	batchDone := make([]chan struct{}, batchCount)
+	for i := range batchDone {
+		batchDone[i] = make(chan struct{})
+	}
+
+	checkpointed := t.loadCheckpoint(items)
+	t.neighbours = newNeighbourContext(itemsToSubtitles(items), t.config)
+
 	// Report initial progress
 	if t.progressChannel != nil {
 		t.progressChannel <- 0.0
 	}
-	
+
 	// Process each batch in a separate goroutine
+batches:
 	for i := 0; i < batchCount; i++ {
-		semaphore <- struct{}{}
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			break batches
+		}
 		slog.Info("Processing translation batch", "batch", i+1, "total", batchCount)
-		
+
 		start := i * batchSize
-		end := min(start+batchSize, len(subs.Items))
-		batch := subs.Items[start:end]
-		
+		end := min(start+batchSize, len(items))
+		batch := items[start:end]
+
+		request := BatchRequest{TargetLanguage: t.config.TargetLanguage}
+
 		wg.Add(1)
 		go func(batch []*astisub.Item, batchIndex int) {
 			defer wg.Done()
-			defer func() { 
-				<-semaphore 
-				
+			defer close(batchDone[batchIndex])
+			defer func() {
+				<-semaphore
+
 				// Update progress after batch completes
 				if t.progressChannel != nil {
 					progressMutex.Lock()
@@ -179,11 +380,46 @@ func (t *Translator) TranslateSubtitles(subs *astisub.Subtitles) error {
 					t.progressChannel <- progress
 				}
 			}()
-			
-			translated, err := t.translateBatch(batch)
+
+			if t.config.ContextTranslations && batchIndex > 0 && t.config.ContextBefore > 0 {
+				// Wait for the previous batch so that its translations can be sent
+				<-batchDone[batchIndex-1]
+			}
+
+			// Subtitles translated by an earlier, interrupted run are restored
+			// from the checkpoint instead of being translated again
+			var translated []Subtitle
+			var remaining []*astisub.Item
+			for _, item := range batch {
+				if translation, ok := checkpointed[item.Index]; ok {
+					translated = append(translated, translation)
+				} else {
+					remaining = append(remaining, item)
+				}
+			}
+
+			var err error
+			if len(remaining) > 0 {
+				var fresh []Subtitle
+				fresh, err = t.translateBatch(ctx, remaining, request)
+				t.saveCheckpoint(fresh)
+				translated = append(translated, fresh...)
+			}
+			t.neighbours.addTranslations(translated)
 			if err != nil {
-				slog.Error("Failed to translate batch", "error", err)
-				return
+				slog.Error("Failed to translate batch", "batch", batchIndex+1, "error", err)
+				failedMutex.Lock()
+				var partialErr *PartialTranslationError
+				if errors.As(err, &partialErr) {
+					failedIndices = append(failedIndices, partialErr.UntranslatedIndices...)
+					lastErr = partialErr.Err
+				} else {
+					for _, item := range batch {
+						failedIndices = append(failedIndices, item.Index)
+					}
+					lastErr = err
+				}
+				failedMutex.Unlock()
 			}
 			translationResultsChan <- translated
 		}(batch, i)
@@ -194,185 +430,497 @@ func (t *Translator) TranslateSubtitles(subs *astisub.Subtitles) error {
 		wg.Wait()
 		close(translationResultsChan)
 	}()
-	
+
 	// Collect and sort all translation results
 	var allTranslations []Subtitle
 	for translations := range translationResultsChan {
 		allTranslations = append(allTranslations, translations...)
 	}
-	
-	// Sort translations by index
-	sort.Slice(allTranslations, func(i, j int) bool {
-		return allTranslations[i].Index < allTranslations[j].Index
-	})
-	
-	// Apply translations to original subtitles
-	for _, sub := range subs.Items {
-		for _, translation := range allTranslations {
-			if sub.Index == translation.Index {
-				for i, line := range sub.Lines {
-					if i < len(translation.Lines) {
-						for j := range line.Items {
-							if j < len(translation.Lines[i].Items) {
-								sub.Lines[i].Items[j].Text = translation.Lines[i].Items[j].Text
-							}
-						}
-					}
-				}
-				break
-			}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Apply translations to original subtitles, restoring protected markup
+	translationsByIndex := make(map[int]Subtitle, len(allTranslations))
+	for _, translation := range allTranslations {
+		translationsByIndex[translation.Index] = translation
+	}
+	for _, sub := range items {
+		if translation, ok := translationsByIndex[sub.Index]; ok {
+			restoreItem(sub, translation)
+		}
+	}
+
+	if len(failedIndices) > 0 {
+		sort.Ints(failedIndices)
+		return &PartialTranslationError{
+			UntranslatedIndices: failedIndices,
+			Total:               len(items),
+			Err:                 lastErr,
 		}
 	}
-	
+
 	return nil
 }
 
-// translateBatch translates a batch of subtitle items
-func (t *Translator) translateBatch(subs []*astisub.Item) ([]Subtitle, error) {
-	// Convert the subtitles to the desired format
-	var subtitles []Subtitle
-	for _, item := range subs {
-		var lines []Line
-		for _, line := range item.Lines {
-			var items []LineItem
-			for _, item := range line.Items {
-				items = append(items, LineItem{
-					Text: item.Text,
-				})
-			}
-			lines = append(lines, Line{
-				Items: items,
-			})
-		}
+// translateBatch translates a batch of subtitle items, sending the context
+// from the given request along with them. If only some of the subtitles could
+// be translated, the translated ones are returned together with a
+// PartialTranslationError listing the others.
+func (t *Translator) translateBatch(ctx context.Context, subs []*astisub.Item, request BatchRequest) ([]Subtitle, error) {
+	subtitles := itemsToSubtitles(subs)
+	request = t.neighbours.apply(request, subtitles)
+	request.Glossary = relevantGlossaryEntries(t.glossary, subtitles, request.ContextBefore, request.ContextAfter)
+
+	// Only subtitles missing from the translation memory are sent
+	translated, pending := t.lookupMemory(subtitles)
+	var err error
+	if len(pending) > 0 {
+		var fresh []Subtitle
+		fresh, err = t.translateWithRepair(ctx, request, pending)
+		t.storeMemory(pending, fresh)
+		translated = append(translated, fresh...)
+	}
 
-		subtitles = append(subtitles, Subtitle{
-			Index: item.Index,
-			Lines: lines,
-		})
+	if violations := checkGlossary(request.Glossary, subtitles, translated); len(violations) > 0 {
+		slog.Warn("Translations do not follow the glossary", "violations", len(violations))
+		t.violationsMutex.Lock()
+		t.violations = append(t.violations, violations...)
+		t.violationsMutex.Unlock()
 	}
 
-	// Marshal the subtitles to JSON
-	jsonData, err := json.Marshal(subtitles)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal subtitles: %w", err)
-	}
-	
-	// Configure the JSON schema for the response
-	schemaParam := openai.ResponseFormatJSONSchemaJSONSchemaParam{
-		Name:        "subtitles",
-		Description: openai.String("Translated subtitles"),
-		Schema:      TranslationResponseSchema,
-		Strict:      openai.Bool(true),
-	}
-	
-	// Prepare the system message based on target language
-	systemMessage := fmt.Sprintf("Translate subtitles to %s", t.config.TargetLanguage)
-	
-	// Call the OpenAI API for translation
-	response, err := t.client.Chat.Completions.New(context.TODO(), openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(systemMessage),
-			openai.UserMessage(string(jsonData)),
-		},
-		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
-			OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{
-				JSONSchema: schemaParam,
-			},
-		},
-		Model: t.config.Model,
-	})
+	return translated, err
+}
+
+// loadCheckpoint returns the translations saved by an earlier run, keyed by
+// index. Translations that do not fit the current subtitles are ignored.
+func (t *Translator) loadCheckpoint(items []*astisub.Item) map[int]Subtitle {
+	checkpointed := make(map[int]Subtitle)
+	if t.checkpoint == nil {
+		return checkpointed
+	}
+
+	saved, err := t.checkpoint.Load()
 	if err != nil {
-		return nil, fmt.Errorf("failed to call translation API: %w", err)
+		slog.Warn("Failed to load translation checkpoint", "error", err)
+		return checkpointed
 	}
 
-	// Unmarshal the response
-	var translationResponse TranslationResponse
-	err = json.Unmarshal([]byte(response.Choices[0].Message.Content), &translationResponse)
+	sources := make(map[int]Subtitle, len(items))
+	for _, sub := range itemsToSubtitles(items) {
+		sources[sub.Index] = sub
+	}
+	for _, translation := range saved {
+		if source, ok := sources[translation.Index]; ok && compareStructure(source, translation) == "" {
+			checkpointed[translation.Index] = translation
+		}
+	}
+
+	if len(checkpointed) > 0 {
+		slog.Info("Resuming translation from checkpoint", "translated", len(checkpointed), "total", len(items))
+	}
+	return checkpointed
+}
+
+// saveCheckpoint saves the translations of a finished batch. Batches finish
+// concurrently, so saves are serialized. Failures are only logged, as the
+// translations are still usable.
+func (t *Translator) saveCheckpoint(translated []Subtitle) {
+	if t.checkpoint == nil || len(translated) == 0 {
+		return
+	}
+	t.checkpointMutex.Lock()
+	defer t.checkpointMutex.Unlock()
+	if err := t.checkpoint.Save(translated); err != nil {
+		slog.Warn("Failed to save translation checkpoint", "error", err)
+	}
+}
+
+// memoryKey returns the translation memory key for the current configuration
+func (t *Translator) memoryKey() TranslationMemoryKey {
+	sourceLanguage := t.sourceLanguage
+	if sourceLanguage == "" {
+		sourceLanguage = UnknownLanguage
+	}
+	targetLanguage := normalizeLanguageCode(t.config.TargetLanguage)
+	if targetLanguage == "" {
+		targetLanguage = t.config.TargetLanguage
+	}
+	return TranslationMemoryKey{
+		SourceLanguage: sourceLanguage,
+		TargetLanguage: targetLanguage,
+		Model:          t.backend.Name() + "/" + t.config.Model,
+		PromptVersion:  PromptVersion,
+	}
+}
+
+// usesGlossary reports whether a subtitle contains a glossary term. Such
+// subtitles bypass the translation memory, as their translations depend on
+// the glossary of the job.
+func (t *Translator) usesGlossary(sub Subtitle) bool {
+	return len(relevantGlossaryEntries(t.glossary, []Subtitle{sub})) > 0
+}
+
+// memoryText returns the translation memory key of a subtitle, covering its
+// neighbours when they are sent as context
+func (t *Translator) memoryText(sub Subtitle) string {
+	text := memorySourceText(sub)
+	if neighbours := t.neighbours.neighboursOf(sub); len(neighbours) > 0 {
+		return memoryContextText(text, neighbours)
+	}
+	return text
+}
+
+// lookupMemory splits subtitles into those with a stored translation, returned
+// translated, and those that still have to be translated
+func (t *Translator) lookupMemory(subtitles []Subtitle) ([]Subtitle, []Subtitle) {
+	if t.memory == nil {
+		return nil, subtitles
+	}
+
+	var sourceTexts []string
+	for _, sub := range subtitles {
+		if !t.usesGlossary(sub) {
+			sourceTexts = append(sourceTexts, t.memoryText(sub))
+		}
+	}
+	if len(sourceTexts) == 0 {
+		return nil, subtitles
+	}
+	stored, err := t.memory.LookupTranslations(t.memoryKey(), sourceTexts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal translation response: %w", err)
+		slog.Warn("Failed to look up translation memory", "error", err)
 	}
 
-	return translationResponse.Subtitles, nil
+	var cached, pending []Subtitle
+	for _, sub := range subtitles {
+		if t.usesGlossary(sub) {
+			pending = append(pending, sub)
+			continue
+		}
+		lines, found := stored[t.memoryText(sub)]
+		translation := Subtitle{Index: sub.Index, Lines: lines}
+		if found && compareStructure(sub, translation) == "" {
+			cached = append(cached, translation)
+		} else {
+			pending = append(pending, sub)
+		}
+	}
+
+	t.memoryHits.Add(int64(len(cached)))
+	t.memoryMisses.Add(int64(len(sourceTexts) - len(cached)))
+	return cached, pending
 }
 
-// deriveOutputPath creates an output path in the same directory as the input file
-// with language segments (eng, eng.hi, en, en.hi) replaced by 'pl'
-// If no language segment is found, it adds 'pl' before the extension
-func deriveOutputPath(inputPath string) string {
-	// Find the last dot for extension
-	lastDotIndex := -1
-	for i := len(inputPath) - 1; i >= 0; i-- {
-		if inputPath[i] == '.' {
-			lastDotIndex = i
-			break
+// storeMemory saves validated translations of the given subtitles in the
+// translation memory. Failures are only logged, as the translations are
+// still usable.
+func (t *Translator) storeMemory(subtitles []Subtitle, translated []Subtitle) {
+	if t.memory == nil || len(translated) == 0 {
+		return
+	}
+
+	sourceTexts := make(map[int]string, len(subtitles))
+	for _, sub := range subtitles {
+		if !t.usesGlossary(sub) {
+			sourceTexts[sub.Index] = t.memoryText(sub)
 		}
 	}
+	entries := make(map[string][]Line, len(translated))
+	for _, sub := range translated {
+		if sourceText, ok := sourceTexts[sub.Index]; ok {
+			entries[sourceText] = sub.Lines
+		}
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if err := t.memory.StoreTranslations(t.memoryKey(), entries); err != nil {
+		slog.Warn("Failed to store translations in translation memory", "error", err)
+	}
+}
 
-	if lastDotIndex == -1 {
-		// No extension found, just append .pl
-		return inputPath + ".pl"
+// itemsToSubtitles converts subtitle items to the format sent to the backend,
+// with markup replaced by placeholders
+func itemsToSubtitles(subs []*astisub.Item) []Subtitle {
+	var subtitles []Subtitle
+	for _, item := range subs {
+		subtitle, _ := protectItem(item)
+		subtitles = append(subtitles, subtitle)
 	}
 
-	// Get base and extension
-	basePath := inputPath[:lastDotIndex]
-	extension := inputPath[lastDotIndex:]
+	return subtitles
+}
 
-	// Check for common suffixes that indicate language codes
-	// First check for multi-part language codes with .hi suffix (highest priority)
-	if hasAnySuffix(basePath, ".eng.hi", ".en.hi") {
-		// Find the last occurrence of either suffix
-		idx := max(lastIndexOf(basePath, ".eng.hi"), lastIndexOf(basePath, ".en.hi"))
-		return basePath[:idx] + ".pl" + extension
+// neighbourContext provides the subtitles around the ones sent to the
+// backend as read-only context. Neighbouring subtitles help the model keep
+// pronouns, gender agreement and running jokes consistent across batches.
+type neighbourContext struct {
+	subtitles []Subtitle  // Dialogue subtitles of the file, in order
+	positions map[int]int // Position of each subtitle by index
+	before    int
+	after     int
+
+	// Translations known so far, nil unless they are sent as context
+	translations map[int]Subtitle
+	mutex        sync.Mutex
+}
+
+// newNeighbourContext creates the context source for the subtitles of a file
+func newNeighbourContext(subtitles []Subtitle, config TranslationConfig) *neighbourContext {
+	c := &neighbourContext{
+		subtitles: subtitles,
+		positions: make(map[int]int, len(subtitles)),
+		before:    config.ContextBefore,
+		after:     config.ContextAfter,
+	}
+	for i, sub := range subtitles {
+		c.positions[sub.Index] = i
+	}
+	if config.ContextTranslations {
+		c.translations = make(map[int]Subtitle)
 	}
+	return c
+}
 
-	if hasAnySuffix(basePath, "_eng.hi", "_en.hi") {
-		// Find the last occurrence of either suffix
-		idx := max(lastIndexOf(basePath, "_eng.hi"), lastIndexOf(basePath, "_en.hi"))
-		return basePath[:idx] + "_pl" + extension
+// apply sets the context of a request sending the given subtitles to their
+// neighbours: the subtitles preceding the first and following the last of
+// them, with the known translations of the preceding ones. A nil context
+// leaves the request without context.
+func (c *neighbourContext) apply(request BatchRequest, subtitles []Subtitle) BatchRequest {
+	request.ContextBefore = nil
+	request.ContextAfter = nil
+	request.PreviousTranslations = nil
+	if c == nil || len(subtitles) == 0 {
+		return request
 	}
 
-	// Then check for simple language codes
-	if hasAnySuffix(basePath, ".eng", ".en") {
-		// Find the last occurrence of either suffix
-		idx := max(lastIndexOf(basePath, ".eng"), lastIndexOf(basePath, ".en"))
-		return basePath[:idx] + ".pl" + extension
+	first, last := len(c.subtitles), -1
+	for _, sub := range subtitles {
+		if position, ok := c.positions[sub.Index]; ok {
+			first = min(first, position)
+			last = max(last, position)
+		}
+	}
+	if last < 0 {
+		return request
 	}
 
-	if hasAnySuffix(basePath, "_eng", "_en") {
-		// Find the last occurrence of either suffix
-		idx := max(lastIndexOf(basePath, "_eng"), lastIndexOf(basePath, "_en"))
-		return basePath[:idx] + "_pl" + extension
+	request.ContextBefore, request.ContextAfter = c.around(first, last)
+
+	if c.translations != nil {
+		c.mutex.Lock()
+		for _, sub := range request.ContextBefore {
+			if translation, ok := c.translations[sub.Index]; ok {
+				request.PreviousTranslations = append(request.PreviousTranslations, translation)
+			}
+		}
+		c.mutex.Unlock()
 	}
+	return request
+}
 
-	// No language segment found, add "pl" as the last segment
-	return basePath + ".pl" + extension
+// around returns the subtitles preceding and following the subtitles at the
+// given positions
+func (c *neighbourContext) around(first, last int) ([]Subtitle, []Subtitle) {
+	return c.subtitles[max(first-c.before, 0):first], c.subtitles[last+1 : min(last+1+c.after, len(c.subtitles))]
 }
 
-// max returns the larger of two integers
-func max(a, b int) int {
-	if a > b {
-		return a
+// neighboursOf returns the subtitles sent as context around a single
+// subtitle, or nil if there are none
+func (c *neighbourContext) neighboursOf(sub Subtitle) []Subtitle {
+	if c == nil {
+		return nil
+	}
+	position, ok := c.positions[sub.Index]
+	if !ok {
+		return nil
 	}
-	return b
+	before, after := c.around(position, position)
+	return append(slices.Clone(before), after...)
 }
 
-// lastIndexOf returns the index of the last occurrence of substr in s,
-// or -1 if substr is not present in s
-func lastIndexOf(s, substr string) int {
-	for i := len(s) - len(substr); i >= 0; i-- {
-		if s[i:i+len(substr)] == substr {
-			return i
+// addTranslations records translations to send as context, if enabled
+func (c *neighbourContext) addTranslations(translated []Subtitle) {
+	if c == nil || c.translations == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, sub := range translated {
+		c.translations[sub.Index] = sub
+	}
+}
+
+// translateWithRepair requests translations for the subtitles and validates
+// the response. Subtitles with broken translations are requested again, and
+// if that does not help the batch is split in halves which are translated
+// separately, down to single subtitles.
+func (t *Translator) translateWithRepair(ctx context.Context, request BatchRequest, subtitles []Subtitle) ([]Subtitle, error) {
+	var accepted []Subtitle
+	pending := subtitles
+	var lastErr error
+
+	for attempt := 0; attempt <= t.config.RepairAttempts && len(pending) > 0; attempt++ {
+		request = t.neighbours.apply(request, pending)
+		request.Subtitles = pending
+		translated, err := t.requestWithRetry(ctx, request)
+		if errors.Is(err, ErrTruncatedResponse) {
+			// The same request would be truncated again, only splitting helps
+			lastErr = err
+			break
+		}
+		if err != nil {
+			return accepted, untranslatedError(subtitles, pending, err)
+		}
+
+		valid, broken, issues := validateTranslations(pending, translated)
+		accepted = append(accepted, valid...)
+		t.neighbours.addTranslations(valid)
+		pending = broken
+		if len(issues) > 0 {
+			slog.Warn("Translation response failed validation", "issues", len(issues),
+				"broken", len(broken), "attempt", attempt+1, "first_issue", issues[0].String())
+			lastErr = fmt.Errorf("invalid translation: %s", issues[0])
+		}
+	}
+
+	if len(pending) == 0 {
+		return accepted, nil
+	}
+	if len(pending) == 1 {
+		return accepted, untranslatedError(subtitles, pending, lastErr)
+	}
+
+	// Fall back to translating each half of the remaining subtitles separately
+	middle := len(pending) / 2
+	slog.Info("Splitting translation batch", "size", len(pending))
+
+	var untranslated []Subtitle
+	for _, half := range [][]Subtitle{pending[:middle], pending[middle:]} {
+		translated, err := t.translateWithRepair(ctx, request, half)
+		accepted = append(accepted, translated...)
+		if err != nil {
+			lastErr = err
+			untranslated = append(untranslated, missingSubtitles(half, translated)...)
 		}
 	}
-	return -1
+
+	if len(untranslated) > 0 {
+		return accepted, untranslatedError(subtitles, untranslated, lastErr)
+	}
+	return accepted, nil
 }
 
-// hasAnySuffix returns true if s ends with any of the provided suffixes
-func hasAnySuffix(s string, suffixes ...string) bool {
-	for _, suffix := range suffixes {
-		if len(s) >= len(suffix) && s[len(s)-len(suffix):] == suffix {
-			return true
+// untranslatedError creates a PartialTranslationError for the untranslated
+// subtitles of a batch
+func untranslatedError(batch []Subtitle, untranslated []Subtitle, err error) error {
+	indices := make([]int, 0, len(untranslated))
+	for _, sub := range untranslated {
+		indices = append(indices, sub.Index)
+	}
+	return &PartialTranslationError{
+		UntranslatedIndices: indices,
+		Total:               len(batch),
+		Err:                 err,
+	}
+}
+
+// missingSubtitles returns the subtitles that have no translation
+func missingSubtitles(subtitles []Subtitle, translated []Subtitle) []Subtitle {
+	done := make(map[int]bool, len(translated))
+	for _, sub := range translated {
+		done[sub.Index] = true
+	}
+
+	var missing []Subtitle
+	for _, sub := range subtitles {
+		if !done[sub.Index] {
+			missing = append(missing, sub)
 		}
 	}
-	return false
-}
\ No newline at end of file
+	return missing
+}
+
+// requestWithRetry sends a batch to the backend, retrying transient failures
+// with exponential backoff and jitter
+func (t *Translator) requestWithRetry(ctx context.Context, request BatchRequest) ([]Subtitle, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Acquire(ctx); err != nil {
+			return nil, err
+		}
+		translated, err := t.backend.TranslateBatch(ctx, request)
+		t.limiter.Release()
+		if err == nil {
+			return translated, nil
+		}
+
+		err = fmt.Errorf("%s backend failed: %w", t.backend.Name(), err)
+		if attempt >= t.config.MaxRetries || !isRetryableError(err) {
+			return nil, err
+		}
+
+		delay := retryDelay(attempt, t.config.RetryBaseDelay, t.config.RetryMaxDelay, err)
+		slog.Warn("Translation request failed, retrying", "attempt", attempt+1,
+			"max_retries", t.config.MaxRetries, "delay", delay, "error", err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isRetryableError reports whether a failed backend call may succeed if repeated.
+// Errors without a status code (network problems, malformed replies) are retried.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrTruncatedResponse) {
+		return false
+	}
+
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.StatusCode == 0 {
+		return true
+	}
+
+	switch code := backendErr.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusConflict, code == http.StatusTooManyRequests:
+		return true
+	case code >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryDelay returns how long to wait before the given retry attempt,
+// preferring the delay requested by the server if there is one
+func retryDelay(attempt int, baseDelay, maxDelay time.Duration, err error) time.Duration {
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) && backendErr.RetryAfter > 0 {
+		return backendErr.RetryAfter
+	}
+
+	delay := baseDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+
+	// Use "equal jitter" so that concurrent batches do not retry in lockstep
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
+
+// sleepContext waits for the given duration or until the context is done
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ValidationIssue describes a problem found in a translated subtitle
+type ValidationIssue struct {
+	Index   int    `json:"index"`
+	Problem string `json:"problem"`
+}
+
+func (i ValidationIssue) String() string {
+	return fmt.Sprintf("subtitle %d: %s", i.Index, i.Problem)
+}
+
+// validateTranslations checks the translations returned for a batch against
+// the source subtitles. It returns the translations that can be used as they
+// are, the source subtitles that have to be requested again and the list of
+// problems that were found.
+func validateTranslations(source []Subtitle, translated []Subtitle) ([]Subtitle, []Subtitle, []ValidationIssue) {
+	var issues []ValidationIssue
+
+	sourceByIndex := make(map[int]Subtitle, len(source))
+	for _, sub := range source {
+		sourceByIndex[sub.Index] = sub
+	}
+
+	// Group the returned translations by index, reporting unexpected ones
+	translatedByIndex := make(map[int]Subtitle, len(translated))
+	duplicated := make(map[int]bool)
+	for _, sub := range translated {
+		if _, expected := sourceByIndex[sub.Index]; !expected {
+			issues = append(issues, ValidationIssue{Index: sub.Index, Problem: "unexpected index"})
+			continue
+		}
+		if _, seen := translatedByIndex[sub.Index]; seen {
+			if !duplicated[sub.Index] {
+				issues = append(issues, ValidationIssue{Index: sub.Index, Problem: "duplicated index"})
+			}
+			duplicated[sub.Index] = true
+			continue
+		}
+		translatedByIndex[sub.Index] = sub
+	}
+
+	var valid, broken []Subtitle
+	for _, sub := range source {
+		translation, found := translatedByIndex[sub.Index]
+		var problem string
+		switch {
+		case !found:
+			problem = "missing from response"
+		case duplicated[sub.Index]:
+			// Already reported, there is no way to tell which copy is right
+		default:
+			problem = compareStructure(sub, translation)
+		}
+
+		if problem != "" {
+			issues = append(issues, ValidationIssue{Index: sub.Index, Problem: problem})
+		}
+		if problem != "" || duplicated[sub.Index] {
+			broken = append(broken, sub)
+			continue
+		}
+		valid = append(valid, translation)
+	}
+
+	return valid, broken, issues
+}
+
+// compareStructure checks that a translation keeps the line and item layout,
+// placeholders and text of its source. It returns an empty string if usable.
+func compareStructure(source, translation Subtitle) string {
+	if len(source.Lines) != len(translation.Lines) {
+		return fmt.Sprintf("expected %d lines, got %d", len(source.Lines), len(translation.Lines))
+	}
+
+	for i, line := range source.Lines {
+		translatedLine := translation.Lines[i]
+		if len(line.Items) != len(translatedLine.Items) {
+			return fmt.Sprintf("line %d: expected %d items, got %d", i+1, len(line.Items), len(translatedLine.Items))
+		}
+		if expected, actual := linePlaceholders(line), linePlaceholders(translatedLine); !slices.Equal(expected, actual) {
+			return fmt.Sprintf("line %d: expected placeholders %v, got %v", i+1, expected, actual)
+		}
+		for j, item := range line.Items {
+			if strings.TrimSpace(item.Text) != "" && strings.TrimSpace(translatedLine.Items[j].Text) == "" {
+				return fmt.Sprintf("line %d: item %d is empty", i+1, j+1)
+			}
+		}
+	}
+
+	return ""
+}
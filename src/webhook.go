@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookJobCreated    = "job.created"
+	WebhookJobCompleted  = "job.completed"
+	WebhookJobFailed     = "job.failed"
+	WebhookScanCompleted = "scan.completed"
+)
+
+// WebhookEvents lists all webhook event types
+var WebhookEvents = []string{WebhookJobCreated, WebhookJobCompleted, WebhookJobFailed, WebhookScanCompleted}
+
+// WebhookSignatureHeader carries the HMAC-SHA256 of the request body, as
+// "sha256=" followed by the hex digest, when the webhook has a secret
+const WebhookSignatureHeader = "X-AISubs-Signature"
+
+// WebhookEventHeader carries the event type of a webhook request
+const WebhookEventHeader = "X-AISubs-Event"
+
+// errWebhookRequest is returned when a webhook request cannot be built,
+// which no retry can fix
+var errWebhookRequest = errors.New("failed to create webhook request")
+
+// Defaults for webhook deliveries
+const (
+	DefaultWebhookMaxAttempts = 5
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+// WebhookConfig describes an endpoint notified about events
+type WebhookConfig struct {
+	URL         string        `yaml:"url"`
+	Events      []string      `yaml:"events"`       // Events to send, all if empty
+	Secret      string        `yaml:"secret"`       // Key for the signature header, no signature if empty
+	MaxAttempts int           `yaml:"max_attempts"` // Delivery attempts before giving up (default: 5)
+	Timeout     time.Duration `yaml:"timeout"`      // Timeout of a single attempt (default: 10s)
+}
+
+// validate checks that the webhook can be delivered
+func (c WebhookConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	parsed, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url '%s': %w", c.URL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid url '%s', expected an http or https url", c.URL)
+	}
+	for _, event := range c.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return fmt.Errorf("unknown event '%s'", event)
+		}
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts cannot be negative, got %d", c.MaxAttempts)
+	}
+	return nil
+}
+
+// wants reports whether the webhook subscribed to the event
+func (c WebhookConfig) wants(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// ScanSummary describes a finished scan of a media path
+type ScanSummary struct {
+	MediaPath string  `json:"mediaPath"`
+	Path      string  `json:"path"`
+	Files     int     `json:"files"`
+	Duration  float64 `json:"durationSeconds"`
+}
+
+// WebhookPayload is the JSON body sent to webhooks
+type WebhookPayload struct {
+	Event      string       `json:"event"`
+	Timestamp  time.Time    `json:"timestamp"`
+	Job        *Job         `json:"job,omitempty"`
+	OutputPath string       `json:"outputPath,omitempty"`
+	Scan       *ScanSummary `json:"scan,omitempty"`
+}
+
+// WebhookDispatcher delivers events to the configured webhooks in the
+// background, retrying failed deliveries with exponential backoff
+type WebhookDispatcher struct {
+	webhooks       []WebhookConfig
+	client         *http.Client
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+}
+
+var webhookDispatcher *WebhookDispatcher
+var webhookDispatcherOnce sync.Once
+
+// GetWebhookDispatcher returns the dispatcher for the configured webhooks
+func GetWebhookDispatcher() *WebhookDispatcher {
+	webhookDispatcherOnce.Do(func() {
+		webhookDispatcher = NewWebhookDispatcher(GetConfig().Webhooks)
+	})
+	return webhookDispatcher
+}
+
+// NewWebhookDispatcher creates a dispatcher for the given webhooks
+func NewWebhookDispatcher(webhooks []WebhookConfig) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		webhooks:       webhooks,
+		client:         &http.Client{},
+		retryBaseDelay: 2 * time.Second,
+		retryMaxDelay:  5 * time.Minute,
+	}
+}
+
+// DispatchJob sends a job event, with the output path of the job
+func (d *WebhookDispatcher) DispatchJob(event string, job Job) {
+	d.Dispatch(WebhookPayload{Event: event, Job: &job, OutputPath: job.Result.OutputPath})
+}
+
+// Dispatch sends an event to every webhook subscribed to it without waiting
+// for the deliveries. A nil dispatcher sends nothing.
+func (d *WebhookDispatcher) Dispatch(payload WebhookPayload) {
+	if d == nil {
+		return
+	}
+
+	payload.Timestamp = time.Now()
+	var body []byte
+	for _, webhook := range d.webhooks {
+		if !webhook.wants(payload.Event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				slog.Error("Error marshaling webhook payload", "event", payload.Event, "error", err)
+				return
+			}
+		}
+		go d.deliver(webhook, payload.Event, body)
+	}
+}
+
+// deliver sends a webhook request, retrying server errors and network failures
+func (d *WebhookDispatcher) deliver(webhook WebhookConfig, event string, body []byte) {
+	maxAttempts := webhook.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		statusCode, err := d.send(webhook, event, body)
+		if err == nil {
+			slog.Debug("Webhook delivered", "url", webhook.URL, "event", event)
+			return
+		}
+
+		retryable := !errors.Is(err, errWebhookRequest) &&
+			(statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500)
+		if attempt >= maxAttempts || !retryable {
+			slog.Warn("Webhook delivery failed", "url", webhook.URL, "event", event,
+				"attempts", attempt, "error", err)
+			return
+		}
+
+		delay := retryDelay(attempt-1, d.retryBaseDelay, d.retryMaxDelay, nil)
+		slog.Debug("Webhook delivery failed, retrying", "url", webhook.URL, "event", event,
+			"attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// send makes a single webhook request, returning the response status code,
+// or 0 if no response was received
+func (d *WebhookDispatcher) send(webhook WebhookConfig, event string, body []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errWebhookRequest, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, event)
+	if webhook.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, "sha256="+signWebhookBody(webhook.Secret, body))
+	}
+
+	timeout := webhook.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	client := *d.client
+	client.Timeout = timeout
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook returned status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// signWebhookBody returns the hex encoded HMAC-SHA256 of the body
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // ErrorResponse defines the structure of error responses
@@ -40,6 +45,11 @@ func RunWebService() {
 	mux.HandleFunc("GET /subtitles/", handleSubtitles)
 	mux.HandleFunc("POST /translate/", handleTranslate)
 	mux.HandleFunc("GET /job/", handleJob)
+	mux.HandleFunc("DELETE /job/", handleCancelJob)
+	mux.HandleFunc("POST /job/retry/", handleRetryJob)
+	mux.HandleFunc("GET /jobs/", handleJobs)
+	mux.HandleFunc("GET /job/events/", handleJobEvents)
+	mux.HandleFunc("GET /jobs/events/", handleAllJobEvents)
 	mux.HandleFunc("GET /media/", handleMedia)
 
 	port := GetPort()
@@ -72,6 +82,222 @@ func handleJob(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(job)
 }
 
+// handleCancelJob handles DELETE requests to the /job endpoint, cancelling a
+// queued or running job
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("id")
+	if jobID == "" {
+		sendErrorResponse(w, "Missing parameter", "The 'id' query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	jm := GetJobManager()
+	if _, err := jm.GetJob(jobID); err != nil {
+		sendErrorResponse(w, "Job not found", err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := jm.CancelJob(jobID); err != nil {
+		sendErrorResponse(w, "Job not cancelled", err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Job cancelled",
+		"job_id":  jobID,
+	})
+}
+
+// handleRetryJob handles the /job/retry endpoint, queuing a failed job again
+func handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("id")
+	if jobID == "" {
+		sendErrorResponse(w, "Missing parameter", "The 'id' query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	jm := GetJobManager()
+	if _, err := jm.GetJob(jobID); err != nil {
+		sendErrorResponse(w, "Job not found", err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := jm.RetryJob(jobID); err != nil {
+		statusCode := http.StatusConflict
+		if errors.Is(err, ErrQueueFull) {
+			statusCode = http.StatusServiceUnavailable
+		}
+		sendErrorResponse(w, "Job not retried", err.Error(), statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Job queued for retry",
+		"job_id":  jobID,
+	})
+}
+
+// Default and maximum number of jobs returned by /jobs
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// handleJobs handles the /jobs endpoint, listing jobs with optional filters
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := JobFilter{
+		PathPrefix: query.Get("path_prefix"),
+		SortBy:     query.Get("sort"),
+		Descending: query.Get("order") != "asc",
+		Limit:      defaultJobsLimit,
+	}
+
+	// Statuses can be given as a comma separated list or repeated
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				filter.Statuses = append(filter.Statuses, JobStatus(status))
+			}
+		}
+	}
+
+	if name := query.Get("media_path"); name != "" {
+		mediaPath, err := GetMediaPath(name)
+		if err != nil {
+			sendErrorResponse(w, "Invalid media path name", fmt.Sprintf("No media path named '%s' found in configuration", name), http.StatusBadRequest)
+			return
+		}
+		filter.MediaRoot = mediaPath
+	}
+
+	if filter.SortBy != "" && !slices.Contains(JobSortFields, filter.SortBy) {
+		sendErrorResponse(w, "Invalid parameter", fmt.Sprintf("Unsupported sort field '%s', expected one of: %s",
+			filter.SortBy, strings.Join(JobSortFields, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	for name, target := range map[string]*time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				sendErrorResponse(w, "Invalid parameter", fmt.Sprintf("'%s' must be an RFC 3339 timestamp", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	for name, target := range map[string]*int{
+		"offset": &filter.Offset,
+		"limit":  &filter.Limit,
+	} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				sendErrorResponse(w, "Invalid parameter", fmt.Sprintf("'%s' must be a non-negative integer", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if filter.Limit == 0 || filter.Limit > maxJobsLimit {
+		filter.Limit = maxJobsLimit
+	}
+
+	jobs, total := GetJobManager().ListJobs(filter)
+	if jobs == nil {
+		jobs = []Job{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"jobs":   jobs,
+		"total":  total,
+		"offset": filter.Offset,
+		"limit":  filter.Limit,
+	})
+}
+
+// jobEventsKeepAlive is how often a comment is sent on idle event streams,
+// so that proxies do not close them
+const jobEventsKeepAlive = 30 * time.Second
+
+// handleJobEvents handles the /job/events endpoint, streaming the status
+// and progress of a single job as Server-Sent Events until it finishes
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("id")
+	if jobID == "" {
+		sendErrorResponse(w, "Missing parameter", "The 'id' query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := GetJobManager().GetJob(jobID); err != nil {
+		sendErrorResponse(w, "Job not found", err.Error(), http.StatusNotFound)
+		return
+	}
+
+	streamJobEvents(w, r, jobID)
+}
+
+// handleAllJobEvents handles the /jobs/events endpoint, streaming the events
+// of all jobs as Server-Sent Events
+func handleAllJobEvents(w http.ResponseWriter, r *http.Request) {
+	streamJobEvents(w, r, "")
+}
+
+// streamJobEvents writes the events of a job, or of all jobs if jobID is
+// empty, until the client disconnects. A single job's stream ends when the
+// job finishes.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, jobID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendErrorResponse(w, "Streaming unsupported", "The connection does not support streaming", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := GetJobManager().Subscribe(jobID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(jobEventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(event.Job)
+			if err != nil {
+				slog.Error("Error marshaling job event", "id", event.Job.ID, "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+
+			if jobID != "" && !event.Job.Status.IsActive() {
+				return
+			}
+		}
+	}
+}
+
 // handleSubtitles handles the /subtitles endpoint
 func handleSubtitles(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
@@ -97,7 +323,7 @@ func handleSubtitles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	slog.Info("Scanning file for subtitles", "path", path)
-	subtitleTracks, err := ff.ListSubtitleTracks(path)
+	subtitleTracks, err := ff.ListSubtitleTracks(r.Context(), path)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Error listing subtitle tracks: %v", err)
 		sendErrorResponse(w, "Subtitle track error", errorMsg, http.StatusInternalServerError)
@@ -118,8 +344,12 @@ func handleSubtitles(w http.ResponseWriter, r *http.Request) {
 // handleTranslate handles the /translate endpoint
 func handleTranslate(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Path       string `json:"path"`
-		TrackIndex int    `json:"track_index"`
+		Path            string   `json:"path"`
+		TrackIndex      *int     `json:"track_index"`
+		TargetLanguages []string `json:"target_languages"`
+		Priority        int      `json:"priority"`
+		Force           bool     `json:"force"`
+		Backend         string   `json:"backend"`
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -153,26 +383,107 @@ func handleTranslate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify the track index is non-negative
-	if request.TrackIndex < 0 {
-		errorMsg := fmt.Sprintf("Invalid track index: %d", request.TrackIndex)
+	if request.TrackIndex != nil && *request.TrackIndex < 0 {
+		errorMsg := fmt.Sprintf("Invalid track index: %d", *request.TrackIndex)
 		sendErrorResponse(w, "Invalid parameter", errorMsg, http.StatusBadRequest)
-		slog.Error("Invalid track index", "index", request.TrackIndex)
+		slog.Error("Invalid track index", "index", *request.TrackIndex)
+		return
+	}
+
+	// Verify the requested backend exists
+	if request.Backend != "" && !slices.Contains(TranslationBackendNames(), request.Backend) {
+		errorMsg := fmt.Sprintf("Unknown backend '%s', available: %s", request.Backend,
+			strings.Join(TranslationBackendNames(), ", "))
+		sendErrorResponse(w, "Invalid parameter", errorMsg, http.StatusBadRequest)
+		slog.Error("Unknown backend", "backend", request.Backend)
+		return
+	}
+
+	// Resolve the target languages to ISO codes
+	targetLanguages, err := normalizeTargetLanguages(request.TargetLanguages)
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", err.Error(), http.StatusBadRequest)
+		slog.Error("Invalid target language", "languages", request.TargetLanguages, "error", err)
 		return
 	}
 
-	// Create a new job and start processing it
+	// Choose the subtitles to translate if no track was given
+	path := request.Path
+	var trackIndex int
+	if request.TrackIndex != nil {
+		trackIndex = *request.TrackIndex
+	} else {
+		path, trackIndex, err = selectSourceSubtitles(r.Context(), request.Path, GetTrackSelectionConfig(), targetLanguages)
+		if errors.Is(err, ErrNoSubtitles) {
+			sendErrorResponse(w, "No subtitles found", err.Error(), http.StatusUnprocessableEntity)
+			slog.Error("No subtitles to translate", "path", request.Path)
+			return
+		} else if err != nil {
+			sendErrorResponse(w, "Track selection error", err.Error(), http.StatusInternalServerError)
+			slog.Error("Error selecting subtitle track", "path", request.Path, "error", err)
+			return
+		}
+		slog.Info("Selected subtitles to translate", "path", path, "track_index", trackIndex)
+	}
+
+	// Reject tracks that cannot be translated before queuing a job
+	if err := checkSourceTrack(r.Context(), path, trackIndex); err != nil {
+		var bitmapErr *BitmapSubtitleError
+		switch {
+		case errors.As(err, &bitmapErr):
+			sendErrorResponse(w, "Image-based subtitles", err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrTrackNotFound):
+			sendErrorResponse(w, "Invalid parameter", err.Error(), http.StatusBadRequest)
+		default:
+			sendErrorResponse(w, "Subtitle track error", err.Error(), http.StatusInternalServerError)
+		}
+		slog.Error("Cannot translate subtitle track", "path", path, "track_index", trackIndex, "error", err)
+		return
+	}
+
+	// Create a new job and queue it for processing
 	jm := GetJobManager()
-	job := jm.CreateJob(request.Path, request.TrackIndex)
-	jm.ProcessJob(job.ID)
+	job, coveredBy, created := jm.CreateJobForLanguages(JobRequest{
+		Path:            path,
+		TrackIndex:      trackIndex,
+		TargetLanguages: targetLanguages,
+		Priority:        request.Priority,
+		Force:           request.Force,
+		Backend:         request.Backend,
+	})
+	if !created {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TranslateResponse{
+			Message:   "Equivalent translation job already exists",
+			JobID:     job.ID,
+			CoveredBy: coveredBy,
+		})
+		return
+	}
+	if err := jm.EnqueueJob(job.ID); err != nil {
+		jm.SetJobError(job.ID, err)
+		sendErrorResponse(w, "Queue full", err.Error(), http.StatusServiceUnavailable)
+		slog.Error("Error queuing job", "id", job.ID, "error", err)
+		return
+	}
 
 	// Return the job ID to the client
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Translation job created",
-		"job_id":  job.ID,
+	json.NewEncoder(w).Encode(TranslateResponse{
+		Message:   "Translation job created",
+		JobID:     job.ID,
+		CoveredBy: coveredBy,
 	})
 }
 
+// TranslateResponse is the body of a successful /translate response
+type TranslateResponse struct {
+	Message string `json:"message"`
+	JobID   string `json:"job_id"`
+	// IDs of the other jobs translating some of the requested languages, by language
+	CoveredBy map[string]string `json:"covered_by,omitempty"`
+}
+
 // handleMedia handles the /media endpoint for listing media files in a directory
 func handleMedia(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Handling media request")
@@ -218,15 +529,15 @@ func handleMedia(w http.ResponseWriter, r *http.Request) {
 
 		if forceRefresh {
 			// Force refresh - scan and update cache
-			groupedMediaFiles, err2 = RefreshMediaFilesCache(db, mediaPath)
+			groupedMediaFiles, err2 = RefreshMediaFilesCache(r.Context(), db, mediaPath)
 		} else {
 			// Try to use cache first, fall back to scanning if needed
-			groupedMediaFiles, err2 = FindMediaFilesWithCache(db, mediaPath)
+			groupedMediaFiles, err2 = FindMediaFilesWithCache(r.Context(), db, mediaPath)
 		}
 	} else {
 		// No database available, just scan directly
 		slog.Info("Scanning directory for media files", "path", mediaPath, "message", "no cache available")
-		groupedMediaFiles, err2 = FindMediaFiles(mediaPath, nil)
+		groupedMediaFiles, err2 = FindMediaFiles(r.Context(), mediaPath, nil)
 	}
 
 	if err2 != nil {